@@ -0,0 +1,102 @@
+// Command keygen adds a JWT signing key to a key directory and schedules it
+// in the manifest:
+//
+//	go run ./cmd/keygen -dir keys -alg EdDSA -not-before 2026-11-01T00:00:00Z
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"github.com/koinav/ecommerce/keyring"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func main() {
+	dir := flag.String("dir", "keys", "key directory")
+	alg := flag.String("alg", "EdDSA", "signing algorithm: EdDSA or RS256")
+	kid := flag.String("kid", "", "key ID (default: derived from -not-before)")
+	notBefore := flag.String("not-before", "", "RFC 3339 time the key starts signing (default: now)")
+	flag.Parse()
+
+	start := time.Now().UTC().Truncate(time.Second)
+	if *notBefore != "" {
+		var err error
+		start, err = time.Parse(time.RFC3339, *notBefore)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *kid == "" {
+		*kid = start.Format("20060102T150405Z")
+	}
+
+	var private interface{}
+	switch *alg {
+	case "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		private = key
+	case "RS256":
+		key, err := rsa.GenerateKey(rand.Reader, 3072)
+		if err != nil {
+			log.Fatal(err)
+		}
+		private = key
+	default:
+		log.Fatal("-alg must be EdDSA or RS256")
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = os.MkdirAll(*dir, 0o700); err != nil {
+		log.Fatal(err)
+	}
+
+	manifest, err := keyring.ReadManifest(*dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal(err)
+	}
+	for _, key := range manifest.Keys {
+		if key.ID == *kid {
+			log.Fatalf("key %q already exists", *kid)
+		}
+	}
+
+	file := *kid + ".pem"
+	err = os.WriteFile(filepath.Join(*dir, file), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	manifest.Keys = append(manifest.Keys, keyring.ManifestKey{ID: *kid, File: file, NotBefore: start})
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Written aside and renamed, so a running server never reads half a file.
+	tmp := filepath.Join(*dir, keyring.ManifestFile+".tmp")
+	if err = os.WriteFile(tmp, raw, 0o600); err != nil {
+		log.Fatal(err)
+	}
+	if err = os.Rename(tmp, filepath.Join(*dir, keyring.ManifestFile)); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("added %s key %q, signing from %s", *alg, *kid, start.Format(time.RFC3339))
+}
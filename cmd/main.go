@@ -1,38 +1,51 @@
 package main
 
 import (
-	"github.com/gin-gonic/gin"
-	"github.com/koinav/ecommerce/controllers"
-	"github.com/koinav/ecommerce/database"
-	"github.com/koinav/ecommerce/middleware"
-	"github.com/koinav/ecommerce/routes"
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"github.com/koinav/ecommerce/config"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/server"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
+	cfg, err := config.Load(os.Args[0], os.Args[1:], os.LookupEnv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
 	}
 
-	app := controllers.NewApp(database.ProductData(database.Client, "Products"), database.UserData(database.Client, "Users"))
-
-	router := gin.New()
-	router.Use(gin.Logger())
+	logger := logging.New(os.Stderr, cfg.Logging.Format, cfg.Logging.Level)
+	// Libraries that log with the standard log package go through it too.
+	slog.SetDefault(logger)
+	logger.Info("configuration loaded", "config", cfg)
 
-	routes.UserRoutes(router)
-	router.Use(middleware.Authentication())
+	startCtx, cancelStart := context.WithTimeout(context.Background(), cfg.Server.StartupTimeout)
+	srv, err := server.New(startCtx, cfg, logger)
+	cancelStart()
+	if err != nil {
+		logger.Error("cannot start the server", "error", err)
+		os.Exit(1)
+	}
 
-	router.GET("/addtocart", app.AddToCart())
-	router.GET("/removeitem", app.RemoveItem())
-	router.GET("/listcart", controllers.GetUserCart())
-	router.POST("/addaddress", controllers.AddAddress())
-	router.PUT("/edithomeaddress", controllers.EditHomeAddress())
-	router.PUT("/editworkaddress", controllers.EditWorkAddress())
-	router.GET("/deleteaddresses", controllers.DeleteAddress())
-	router.GET("/cartcheckout", app.BuyFromCart())
-	router.GET("/instantbuy", app.InstantBuy())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		// A second signal during the drain kills the process at once.
+		<-ctx.Done()
+		stop()
+	}()
 
-	log.Fatal(router.Run(":" + port))
+	if err = srv.Run(ctx); err != nil {
+		logger.Error("server stopped with an error", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("server stopped")
 }
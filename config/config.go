@@ -0,0 +1,219 @@
+// Package config holds the settings of the server. They are read from an
+// optional YAML or TOML file, then environment variables, then command line
+// flags, each source overriding the one before.
+//
+// Every setting has a key, used in the file as section.key and as the flag
+// name (-section.key), and most have an environment variable.
+package config
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Server   Server   `key:"server"`
+	Database Database `key:"database"`
+	Tokens   Tokens   `key:"tokens"`
+	Security Security `key:"security"`
+	Features Features `key:"features"`
+	Mail     Mail     `key:"mail"`
+	OIDC     OIDC     `key:"oidc"`
+	Shop     Shop     `key:"shop"`
+	Tracing  Tracing  `key:"tracing"`
+	Logging  Logging  `key:"logging"`
+}
+
+type Server struct {
+	Port string `key:"port" env:"PORT"`
+	// PublicURL is where clients reach the server; links in emails start
+	// with it. Defaults to http://localhost:Port.
+	PublicURL           string        `key:"public_url" env:"PUBLIC_URL"`
+	TrustedProxies      []string      `key:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	AuthRatePerMinute   int           `key:"auth_rate_per_minute" env:"AUTH_RATE_PER_MINUTE"`
+	SearchRatePerMinute int           `key:"search_rate_per_minute" env:"SEARCH_RATE_PER_MINUTE"`
+	StartupTimeout      time.Duration `key:"startup_timeout" env:"STARTUP_TIMEOUT"`
+	ReadTimeout         time.Duration `key:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout        time.Duration `key:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout         time.Duration `key:"idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+	// ShutdownDelay keeps serving with /readyz failing after the signal, so
+	// that load balancers take the instance out before it stops listening.
+	ShutdownDelay time.Duration `key:"shutdown_delay" env:"SHUTDOWN_DELAY"`
+	// ShutdownTimeout is how long in-flight requests may finish after
+	// SIGINT or SIGTERM before their connections are closed.
+	ShutdownTimeout time.Duration `key:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+type Database struct {
+	URI  string `key:"uri" env:"MONGODB_URI" secret:"url"`
+	Name string `key:"name" env:"MONGODB_DATABASE"`
+	// Timeout bounds every database operation.
+	Timeout time.Duration `key:"timeout" env:"MONGODB_TIMEOUT"`
+}
+
+type Tokens struct {
+	KeysDir string `key:"keys_dir" env:"JWT_KEYS_DIR"`
+	// KeyOverlap is how long a replaced key still verifies tokens; it must
+	// outlast RefreshTTL.
+	KeyOverlap         time.Duration `key:"key_overlap" env:"JWT_KEY_OVERLAP"`
+	KeysReloadInterval time.Duration `key:"keys_reload_interval" env:"JWT_KEYS_RELOAD_INTERVAL"`
+	AccessTTL          time.Duration `key:"access_ttl" env:"ACCESS_TOKEN_TTL"`
+	RefreshTTL         time.Duration `key:"refresh_ttl" env:"REFRESH_TOKEN_TTL"`
+	PreAuthTTL         time.Duration `key:"pre_auth_ttl" env:"PRE_AUTH_TOKEN_TTL"`
+}
+
+type Security struct {
+	BcryptCost       int           `key:"bcrypt_cost" env:"BCRYPT_COST"`
+	TOTPIssuer       string        `key:"totp_issuer" env:"TOTP_ISSUER"`
+	LoginMaxFailures int           `key:"login_max_failures" env:"LOGIN_MAX_FAILURES"`
+	LoginLockout     time.Duration `key:"login_lockout" env:"LOGIN_LOCKOUT"`
+	LoginLockoutMax  time.Duration `key:"login_lockout_max" env:"LOGIN_LOCKOUT_MAX"`
+	// LoginIPMaxFailures defaults to four times LoginMaxFailures, as many
+	// users may share an IP behind NAT.
+	LoginIPMaxFailures int           `key:"login_ip_max_failures" env:"LOGIN_IP_MAX_FAILURES"`
+	AccountUnlockTTL   time.Duration `key:"account_unlock_ttl" env:"ACCOUNT_UNLOCK_TTL"`
+}
+
+type Features struct {
+	RequireVerifiedEmail bool `key:"require_verified_email" env:"REQUIRE_VERIFIED_EMAIL"`
+	RequireAdmin2FA      bool `key:"require_admin_2fa" env:"REQUIRE_ADMIN_2FA"`
+}
+
+type Mail struct {
+	Driver                     string        `key:"driver" env:"MAIL_DRIVER"`
+	File                       string        `key:"file" env:"MAIL_FILE"`
+	From                       string        `key:"from" env:"MAIL_FROM"`
+	SMTPHost                   string        `key:"smtp_host" env:"SMTP_HOST"`
+	SMTPPort                   string        `key:"smtp_port" env:"SMTP_PORT"`
+	SMTPUsername               string        `key:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword               string        `key:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+	PasswordResetURL           string        `key:"password_reset_url" env:"PASSWORD_RESET_URL"`
+	PasswordResetTTL           time.Duration `key:"password_reset_ttl" env:"PASSWORD_RESET_TTL"`
+	VerificationTTL            time.Duration `key:"verification_ttl" env:"EMAIL_VERIFICATION_TTL"`
+	VerificationResendInterval time.Duration `key:"verification_resend_interval" env:"EMAIL_VERIFICATION_RESEND_INTERVAL"`
+}
+
+// OIDC configures external login; it is off while Issuer is empty.
+type OIDC struct {
+	Issuer       string   `key:"issuer" env:"OIDC_ISSUER"`
+	ClientID     string   `key:"client_id" env:"OIDC_CLIENT_ID"`
+	ClientSecret string   `key:"client_secret" env:"OIDC_CLIENT_SECRET" secret:"true"`
+	RedirectURL  string   `key:"redirect_url" env:"OIDC_REDIRECT_URL"`
+	Scopes       []string `key:"scopes" env:"OIDC_SCOPES"`
+}
+
+type Shop struct {
+	DefaultCurrency     string `key:"default_currency" env:"DEFAULT_CURRENCY"`
+	MoneyRounding       string `key:"money_rounding" env:"MONEY_ROUNDING"`
+	ExchangeRatesFile   string `key:"exchange_rates_file" env:"EXCHANGE_RATES_FILE"`
+	TaxRulesFile        string `key:"tax_rules_file" env:"TAX_RULES_FILE"`
+	DefaultCountry      string `key:"default_country" env:"DEFAULT_COUNTRY"`
+	TaxDefaultCountry   string `key:"tax_default_country" env:"TAX_DEFAULT_COUNTRY"`
+	PricesIncludeTax    bool   `key:"prices_include_tax" env:"PRICES_INCLUDE_TAX"`
+	ShippingMethodsFile string `key:"shipping_methods_file" env:"SHIPPING_METHODS_FILE"`
+	AddressBookLimit    int    `key:"address_book_limit" env:"ADDRESS_BOOK_LIMIT"`
+}
+
+// Tracing configures OpenTelemetry; the variables are the standard ones of
+// the OpenTelemetry SDKs.
+type Tracing struct {
+	// Exporter is none, otlp or stdout.
+	Exporter string `key:"exporter" env:"OTEL_TRACES_EXPORTER"`
+	// Endpoint is the URL of the OTLP/HTTP collector, e.g.
+	// http://localhost:4318; the exporter's own default when empty.
+	Endpoint    string `key:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	ServiceName string `key:"service_name" env:"OTEL_SERVICE_NAME"`
+}
+
+type Logging struct {
+	// Format is json or text.
+	Format string `key:"format" env:"LOG_FORMAT"`
+	// Level is debug, info, warn or error.
+	Level string `key:"level" env:"LOG_LEVEL"`
+}
+
+// Default returns the settings used where no source sets a value.
+func Default() Config {
+	return Config{
+		Server: Server{
+			Port:                "8000",
+			AuthRatePerMinute:   10,
+			SearchRatePerMinute: 120,
+			StartupTimeout:      10 * time.Second,
+			ReadTimeout:         15 * time.Second,
+			WriteTimeout:        30 * time.Second,
+			IdleTimeout:         2 * time.Minute,
+			ShutdownTimeout:     30 * time.Second,
+		},
+		Database: Database{
+			// Credentials are never defaulted; pass them in MONGODB_URI.
+			URI:     "mongodb://localhost:27017",
+			Name:    "Ecommerce",
+			Timeout: 10 * time.Second,
+		},
+		Tokens: Tokens{
+			// Refresh tokens live for a week, so replaced keys verify a bit longer.
+			KeyOverlap:         169 * time.Hour,
+			KeysReloadInterval: time.Minute,
+			AccessTTL:          24 * time.Hour,
+			RefreshTTL:         168 * time.Hour,
+			PreAuthTTL:         5 * time.Minute,
+		},
+		Security: Security{
+			BcryptCost:       bcrypt.DefaultCost,
+			TOTPIssuer:       "Ecommerce",
+			LoginMaxFailures: 5,
+			LoginLockout:     time.Minute,
+			LoginLockoutMax:  time.Hour,
+			AccountUnlockTTL: 24 * time.Hour,
+		},
+		Features: Features{
+			RequireAdmin2FA: true,
+		},
+		Mail: Mail{
+			Driver:                     "file",
+			File:                       "mail.log",
+			PasswordResetTTL:           time.Hour,
+			VerificationTTL:            48 * time.Hour,
+			VerificationResendInterval: time.Minute,
+		},
+		OIDC: OIDC{
+			Scopes: []string{"email", "profile"},
+		},
+		Shop: Shop{
+			DefaultCurrency:  "RUB",
+			MoneyRounding:    "half_up",
+			DefaultCountry:   "RU",
+			PricesIncludeTax: true,
+			AddressBookLimit: 10,
+		},
+		Tracing: Tracing{
+			Exporter:    "none",
+			ServiceName: "ecommerce",
+		},
+		Logging: Logging{
+			Format: "json",
+			Level:  "info",
+		},
+	}
+}
+
+// complete fills in the settings that default to other settings.
+func (config *Config) complete() {
+	if config.Server.PublicURL == "" {
+		config.Server.PublicURL = "http://localhost:" + config.Server.Port
+	}
+	config.Server.PublicURL = strings.TrimRight(config.Server.PublicURL, "/")
+	config.Shop.DefaultCurrency = strings.ToUpper(config.Shop.DefaultCurrency)
+
+	if config.Security.LoginIPMaxFailures == 0 {
+		config.Security.LoginIPMaxFailures = 4 * config.Security.LoginMaxFailures
+	}
+	if config.OIDC.RedirectURL == "" {
+		config.OIDC.RedirectURL = config.Server.PublicURL + "/users/oidc/callback"
+	}
+	if config.Shop.TaxDefaultCountry == "" {
+		config.Shop.TaxDefaultCountry = config.Shop.DefaultCountry
+	}
+}
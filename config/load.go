@@ -0,0 +1,273 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrUnknownFormat = errors.New("config file must be .yaml, .yml or .toml")
+
+// setting is one leaf of Config.
+type setting struct {
+	key    string
+	env    string
+	secret string
+	value  reflect.Value
+}
+
+// Load builds the configuration from the defaults, the file named by the
+// -config flag or CONFIG_FILE, the environment and the flags in args, and
+// validates it. lookupEnv is usually os.LookupEnv; empty variables are
+// treated as unset.
+func Load(name string, args []string, lookupEnv func(string) (string, bool), output io.Writer) (Config, error) {
+	config := Default()
+	settings := settingsOf(&config)
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(output)
+	configFile := flags.String("config", "", "YAML or TOML file with the settings (env CONFIG_FILE)")
+	for _, s := range settings {
+		usage := "see " + s.key + " in the config file"
+		if s.env != "" {
+			usage = "env " + s.env
+		}
+		// Bool flags can be given without a value, e.g. -features.require_verified_email.
+		if s.value.Kind() == reflect.Bool {
+			flags.Bool(s.key, false, usage)
+			continue
+		}
+		flags.String(s.key, "", usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	env := func(name string) (string, bool) {
+		value, ok := lookupEnv(name)
+		return value, ok && value != ""
+	}
+
+	path := *configFile
+	if path == "" {
+		path, _ = env("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := loadFile(path, settings); err != nil {
+			return Config{}, err
+		}
+	}
+
+	for _, s := range settings {
+		if s.env == "" {
+			continue
+		}
+		if value, ok := env(s.env); ok {
+			if err := s.set(value); err != nil {
+				return Config{}, fmt.Errorf("env %s: %w", s.env, err)
+			}
+		}
+	}
+
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+		for _, s := range settings {
+			if s.key == f.Name {
+				if setErr := s.set(f.Value.String()); setErr != nil {
+					err = fmt.Errorf("flag -%s: %w", f.Name, setErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return Config{}, err
+	}
+
+	config.complete()
+	if err = config.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	return config, nil
+}
+
+func loadFile(path string, settings []setting) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var document map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &document)
+	case ".toml":
+		err = toml.Unmarshal(content, &document)
+	default:
+		return ErrUnknownFormat
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := make(map[string]interface{})
+	for section, body := range document {
+		fields, ok := body.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %s must be a section", path, section)
+		}
+		for field, value := range fields {
+			values[section+"."+field] = value
+		}
+	}
+
+	for _, s := range settings {
+		value, ok := values[s.key]
+		if !ok {
+			continue
+		}
+		delete(values, s.key)
+
+		if list, ok := value.([]interface{}); ok && s.value.Kind() == reflect.Slice {
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = fmt.Sprint(item)
+			}
+			s.value.Set(reflect.ValueOf(items))
+			continue
+		}
+		if err = s.set(fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, s.key, err)
+		}
+	}
+
+	for key := range values {
+		return fmt.Errorf("%s: unknown setting %s", path, key)
+	}
+
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func (s *setting) set(raw string) error {
+	raw = strings.TrimSpace(raw)
+
+	switch {
+	case s.value.Type() == durationType:
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(int64(duration))
+	case s.value.Kind() == reflect.String:
+		s.value.SetString(raw)
+	case s.value.Kind() == reflect.Int:
+		number, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", raw)
+		}
+		s.value.SetInt(int64(number))
+	case s.value.Kind() == reflect.Bool:
+		flag, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", raw)
+		}
+		s.value.SetBool(flag)
+	case s.value.Kind() == reflect.Slice:
+		items := strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == ' ' })
+		s.value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", s.value.Type())
+	}
+
+	return nil
+}
+
+// settingsOf lists the leaves of config, addressable so they can be set.
+func settingsOf(config *Config) []setting {
+	var settings []setting
+
+	sections := reflect.ValueOf(config).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		sectionKey := sections.Type().Field(i).Tag.Get("key")
+
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Type().Field(j)
+			settings = append(settings, setting{
+				key:    sectionKey + "." + field.Tag.Get("key"),
+				env:    field.Tag.Get("env"),
+				secret: field.Tag.Get("secret"),
+				value:  section.Field(j),
+			})
+		}
+	}
+
+	return settings
+}
+
+// String lists the settings one per line with secrets masked.
+func (config Config) String() string {
+	var out strings.Builder
+	for _, s := range config.redacted() {
+		out.WriteString(s.key + " = " + s.value + "\n")
+	}
+
+	return out.String()
+}
+
+// LogValue logs the settings as attributes, with secrets masked, so that the
+// configuration can be passed to a slog.Logger as is.
+func (config Config) LogValue() slog.Value {
+	settings := config.redacted()
+	attrs := make([]slog.Attr, len(settings))
+	for i, s := range settings {
+		attrs[i] = slog.String(s.key, s.value)
+	}
+
+	return slog.GroupValue(attrs...)
+}
+
+type shownSetting struct {
+	key   string
+	value string
+}
+
+func (config Config) redacted() []shownSetting {
+	var shown []shownSetting
+
+	for _, s := range settingsOf(&config) {
+		value := fmt.Sprint(s.value.Interface())
+		switch {
+		case s.secret == "url":
+			if parsed, err := url.Parse(value); err == nil {
+				value = parsed.Redacted()
+			} else {
+				value = redactedValue
+			}
+		case s.secret != "" && value != "":
+			value = redactedValue
+		}
+
+		shown = append(shown, shownSetting{key: s.key, value: value})
+	}
+
+	return shown
+}
+
+const redactedValue = "[redacted]"
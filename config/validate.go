@@ -0,0 +1,118 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/koinav/ecommerce/money"
+	"golang.org/x/crypto/bcrypt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validate reports every invalid setting at once, so that a bad deployment
+// can be fixed in one go.
+func (config *Config) Validate() error {
+	var problems []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Errorf(format, args...))
+		}
+	}
+	positive := func(key string, value time.Duration) {
+		check(value > 0, "%s must be a positive duration", key)
+	}
+	atLeastOne := func(key string, value int) {
+		check(value >= 1, "%s must be a positive number", key)
+	}
+
+	port, err := strconv.Atoi(config.Server.Port)
+	check(err == nil && port > 0 && port <= 65535, "server.port must be a port number")
+	check(isHTTPURL(config.Server.PublicURL), "server.public_url must be an http or https URL")
+	atLeastOne("server.auth_rate_per_minute", config.Server.AuthRatePerMinute)
+	atLeastOne("server.search_rate_per_minute", config.Server.SearchRatePerMinute)
+	positive("server.startup_timeout", config.Server.StartupTimeout)
+	positive("server.read_timeout", config.Server.ReadTimeout)
+	positive("server.write_timeout", config.Server.WriteTimeout)
+	positive("server.idle_timeout", config.Server.IdleTimeout)
+	check(config.Server.ShutdownDelay >= 0, "server.shutdown_delay must not be negative")
+	positive("server.shutdown_timeout", config.Server.ShutdownTimeout)
+
+	check(strings.HasPrefix(config.Database.URI, "mongodb://") || strings.HasPrefix(config.Database.URI, "mongodb+srv://"),
+		"database.uri must be a mongodb:// or mongodb+srv:// URI")
+	check(config.Database.Name != "", "database.name must be set")
+	positive("database.timeout", config.Database.Timeout)
+
+	check(config.Tokens.KeysDir != "", "tokens.keys_dir must point to the JWT signing keys, see cmd/keygen")
+	positive("tokens.keys_reload_interval", config.Tokens.KeysReloadInterval)
+	positive("tokens.access_ttl", config.Tokens.AccessTTL)
+	positive("tokens.refresh_ttl", config.Tokens.RefreshTTL)
+	positive("tokens.pre_auth_ttl", config.Tokens.PreAuthTTL)
+	check(config.Tokens.KeyOverlap >= config.Tokens.RefreshTTL,
+		"tokens.key_overlap must be at least tokens.refresh_ttl, or refresh tokens die with their key")
+
+	check(config.Security.BcryptCost >= bcrypt.MinCost && config.Security.BcryptCost <= bcrypt.MaxCost,
+		"security.bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	check(config.Security.TOTPIssuer != "", "security.totp_issuer must be set")
+	atLeastOne("security.login_max_failures", config.Security.LoginMaxFailures)
+	atLeastOne("security.login_ip_max_failures", config.Security.LoginIPMaxFailures)
+	positive("security.login_lockout", config.Security.LoginLockout)
+	check(config.Security.LoginLockoutMax >= config.Security.LoginLockout,
+		"security.login_lockout_max must be at least security.login_lockout")
+	positive("security.account_unlock_ttl", config.Security.AccountUnlockTTL)
+
+	switch config.Mail.Driver {
+	case "file":
+		check(config.Mail.File != "", "mail.file must be set for the file driver")
+	case "memory":
+	case "smtp":
+		check(config.Mail.SMTPHost != "" && config.Mail.SMTPPort != "",
+			"mail.smtp_host and mail.smtp_port must be set for the smtp driver")
+		check(config.Mail.From != "", "mail.from must be set for the smtp driver")
+	default:
+		check(false, "mail.driver must be smtp, file or memory")
+	}
+	check(config.Mail.PasswordResetURL == "" || isHTTPURL(config.Mail.PasswordResetURL),
+		"mail.password_reset_url must be an http or https URL")
+	positive("mail.password_reset_ttl", config.Mail.PasswordResetTTL)
+	positive("mail.verification_ttl", config.Mail.VerificationTTL)
+	check(config.Mail.VerificationResendInterval >= 0, "mail.verification_resend_interval must not be negative")
+
+	if config.OIDC.Issuer != "" {
+		check(isHTTPURL(config.OIDC.Issuer), "oidc.issuer must be an http or https URL")
+		check(config.OIDC.ClientID != "", "oidc.client_id must be set when oidc.issuer is")
+		check(isHTTPURL(config.OIDC.RedirectURL), "oidc.redirect_url must be an http or https URL")
+		check(len(config.OIDC.Scopes) > 0, "oidc.scopes must not be empty")
+	}
+
+	check(money.Supported(config.Shop.DefaultCurrency), "shop.default_currency: %v", money.ErrUnknownCurrency)
+	check(config.Shop.MoneyRounding == "half_up" || config.Shop.MoneyRounding == "half_even",
+		"shop.money_rounding must be half_up or half_even")
+	check(config.Shop.DefaultCountry != "", "shop.default_country must be set")
+	atLeastOne("shop.address_book_limit", config.Shop.AddressBookLimit)
+
+	switch config.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		check(config.Tracing.Endpoint == "" || isHTTPURL(config.Tracing.Endpoint),
+			"tracing.endpoint must be an http or https URL")
+	default:
+		check(false, "tracing.exporter must be none, otlp or stdout")
+	}
+	check(config.Tracing.ServiceName != "", "tracing.service_name must be set")
+
+	check(config.Logging.Format == "json" || config.Logging.Format == "text", "logging.format must be json or text")
+	switch config.Logging.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		check(false, "logging.level must be debug, info, warn or error")
+	}
+
+	return errors.Join(problems...)
+}
+
+func isHTTPURL(raw string) bool {
+	parsed, err := url.Parse(raw)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
@@ -2,200 +2,199 @@ package controllers
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/database"
 	"github.com/koinav/ecommerce/models"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/koinav/ecommerce/postal"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 	"net/http"
 	"time"
 )
 
-func AddAddress() gin.HandlerFunc {
+func (app *Application) ListAddresses() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID := c.Query("userID")
-		if userID == "" {
-			c.JSON(http.StatusNotFound, gin.H{"error": "invalid userID"})
-			c.Abort()
-			return
-		}
+		userID := c.GetString("uid")
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 100*time.Second)
+		defer cancel()
 
-		id, err := primitive.ObjectIDFromHex(userID)
+		addresses, err := app.users.ListAddresses(ctx, userID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, "Internal error")
+			addressError(c, err)
 			return
 		}
 
-		var address models.Address
-		address.AddressID = primitive.NewObjectID()
+		c.JSON(http.StatusOK, addresses)
+	}
+}
 
-		if err = c.BindJSON(&address); err != nil {
-			c.JSON(http.StatusNotAcceptable, err.Error())
+func (app *Application) GetAddress() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, addressID, ok := addressQuery(c)
+		if !ok {
 			return
 		}
 
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 100*time.Second)
 		defer cancel()
 
-		matchFilter := bson.D{{Key: "$match", Value: bson.D{primitive.E{Key: "_id", Value: id}}}}
-		unwind := bson.D{{Key: "$unwind", Value: bson.D{primitive.E{Key: "path", Value: "$address"}}}}
-		group := bson.D{
-			{Key: "$group", Value: bson.D{primitive.E{Key: "_id", Value: "$address_id"},
-				{Key: "count", Value: bson.D{primitive.E{Key: "&sum", Value: 1}}}}},
-		}
-
-		pointCursor, err := UserCollection.Aggregate(ctx, mongo.Pipeline{matchFilter, unwind, group})
+		address, err := app.users.GetAddress(ctx, userID, addressID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, "Internal error")
-			return
-		}
-
-		var addressInfo []bson.M
-		if err = pointCursor.All(ctx, &addressInfo); err != nil {
-			c.JSON(http.StatusInternalServerError, "Internal error")
-			return
-		}
-
-		var size int32
-		for _, addressNo := range addressInfo {
-			count := addressNo["count"]
-			size = count.(int32)
-		}
-		if size < 2 {
-			filter := bson.D{primitive.E{Key: "_id", Value: address}}
-			update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "address", Value: address}}}}
-			_, err := UserCollection.UpdateOne(ctx, filter, update)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-		} else {
-			c.JSON(http.StatusBadRequest, "Not allowed")
+			addressError(c, err)
 			return
 		}
 
-		ctx.Done()
-		c.JSON(http.StatusOK, "Updated successfully")
+		c.JSON(http.StatusOK, address)
 	}
 }
 
-func EditHomeAddress() gin.HandlerFunc {
+func (app *Application) AddAddress() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID := c.Query("id")
-		if userID == "" {
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"error": "Invalid"})
-			c.Abort()
+		userID := c.GetString("uid")
+
+		var address models.Address
+		if err := c.BindJSON(&address); err != nil {
+			c.JSON(http.StatusNotAcceptable, errorBody(c, err.Error()))
 			return
 		}
 
-		id, err := primitive.ObjectIDFromHex(userID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, "internal error")
+		if err := app.validate.Struct(address); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
 			return
 		}
 
-		var editAddress models.Address
-		if err = c.BindJSON(&editAddress); err != nil {
-			c.JSON(http.StatusNotAcceptable, err.Error())
+		if !app.checkAddress(c, &address) {
 			return
 		}
 
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 100*time.Second)
 		defer cancel()
 
-		filter := bson.D{primitive.E{Key: "_id", Value: id}}
-		update := bson.D{{Key: "$set", Value: bson.D{
-			primitive.E{Key: "address.0.house_name", Value: editAddress.House},
-			primitive.E{Key: "address.0.street_name", Value: editAddress.Street},
-			primitive.E{Key: "address.0.city_name", Value: editAddress.City},
-			primitive.E{Key: "address.0.post_code", Value: editAddress.PostCode}}}}
-
-		_, err = UserCollection.UpdateOne(ctx, filter, update)
+		err := app.users.AddAddress(ctx, userID, &address, app.addressLimit)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, "Something went wrong")
+			addressError(c, err)
 			return
 		}
 
-		ctx.Done()
-		c.JSON(http.StatusOK, "Updated successfully")
+		c.JSON(http.StatusCreated, address)
 	}
 }
 
-func EditWorkAddress() gin.HandlerFunc {
+func (app *Application) EditAddress() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID := c.Query("id")
-		if userID == "" {
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"error": "Invalid"})
-			c.Abort()
+		userID, addressID, ok := addressQuery(c)
+		if !ok {
 			return
 		}
 
-		id, err := primitive.ObjectIDFromHex(userID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, "internal error")
+		var editAddress models.Address
+		if err := c.BindJSON(&editAddress); err != nil {
+			c.JSON(http.StatusNotAcceptable, errorBody(c, err.Error()))
 			return
 		}
 
-		var editAddress models.Address
-		if err = c.BindJSON(&editAddress); err != nil {
-			c.JSON(http.StatusNotAcceptable, err.Error())
+		if err := app.validate.Struct(editAddress); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
 			return
 		}
 
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-		defer cancel()
+		if !app.checkAddress(c, &editAddress) {
+			return
+		}
 
-		filter := bson.D{primitive.E{Key: "_id", Value: id}}
-		update := bson.D{{Key: "$set", Value: bson.D{
-			primitive.E{Key: "address.1.house_name", Value: editAddress.House},
-			primitive.E{Key: "address.1.street_name", Value: editAddress.Street},
-			primitive.E{Key: "address.1.city_name", Value: editAddress.City},
-			primitive.E{Key: "address.1.post_code", Value: editAddress.PostCode}}}}
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 100*time.Second)
+		defer cancel()
 
-		_, err = UserCollection.UpdateOne(ctx, filter, update)
+		err := app.users.UpdateAddress(ctx, userID, addressID, editAddress)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, "Something went wrong")
+			addressError(c, err)
 			return
 		}
 
-		ctx.Done()
 		c.JSON(http.StatusOK, "Updated successfully")
 	}
 }
 
-func DeleteAddress() gin.HandlerFunc {
+func (app *Application) DeleteAddress() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID := c.Query("id")
-
-		if userID == "" {
-			c.Header("Content-Type", "application/json")
-			c.JSON(http.StatusNotFound, gin.H{"error": "invalid search index"})
-			c.Abort()
+		userID, addressID, ok := addressQuery(c)
+		if !ok {
 			return
 		}
 
-		addresses := make([]models.Address, 0)
-		id, err := primitive.ObjectIDFromHex(userID)
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 100*time.Second)
+		defer cancel()
+
+		err := app.users.DeleteAddress(ctx, userID, addressID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, "internal error")
+			addressError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, "deleted successfully")
+	}
+}
+
+func (app *Application) SetDefaultAddress() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, addressID, ok := addressQuery(c)
+		if !ok {
 			return
 		}
 
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 100*time.Second)
 		defer cancel()
 
-		filter := bson.D{primitive.E{Key: "_id", Value: id}}
-		update := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "address", Value: addresses}}}}
-		_, err = UserCollection.UpdateOne(ctx, filter, update)
+		err := app.users.SetDefaultAddress(ctx, userID, addressID, c.Query("type"))
 		if err != nil {
-			c.JSON(http.StatusNotFound, "wrong command")
+			addressError(c, err)
 			return
 		}
 
-		ctx.Done()
-		c.JSON(http.StatusOK, "deleted successfully")
+		c.JSON(http.StatusOK, "Updated successfully")
+	}
+}
+
+// checkAddress normalises the address in place and reports field errors to
+// the client.
+func (app *Application) checkAddress(c *gin.Context, address *models.Address) bool {
+	app.addressValidator.Normalize(address)
+
+	err := app.addressValidator.Validate(address)
+	var fieldErrors postal.FieldErrors
+	if errors.As(err, &fieldErrors) {
+		body := errorBody(c, "invalid address")
+		body["fields"] = fieldErrors
+		c.JSON(http.StatusUnprocessableEntity, body)
+		return false
+	}
+
+	return true
+}
+
+// addressQuery reads the address of the authenticated user the request is
+// about.
+func addressQuery(c *gin.Context) (string, primitive.ObjectID, bool) {
+	addressID, err := primitive.ObjectIDFromHex(c.Query("addressID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, "invalid addressID"))
+		c.Abort()
+		return "", primitive.NilObjectID, false
+	}
+
+	return c.GetString("uid"), addressID, true
+}
+
+func addressError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, database.ErrUserIdIsNotValid), errors.Is(err, database.ErrInvalidAddressUsage):
+		c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+	case errors.Is(err, database.ErrCantFindUser), errors.Is(err, database.ErrCantFindAddress):
+		c.JSON(http.StatusNotFound, errorBody(c, err.Error()))
+	case errors.Is(err, database.ErrAddressBookFull):
+		c.JSON(http.StatusConflict, errorBody(c, err.Error()))
+	default:
+		c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
 	}
 }
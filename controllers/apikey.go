@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/tokens"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"time"
+)
+
+type apiKeyRequest struct {
+	Name      string   `json:"name" validate:"required,max=100"`
+	Scopes    []string `json:"scopes" validate:"required,min=1,dive,oneof=products:write shipments:write"`
+	ExpiresIn string   `json:"expires_in"`
+}
+
+// CreateAPIKey issues a key for a machine client. The key is shown in this
+// response only.
+func (app *Application) CreateAPIKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request apiKeyRequest
+		if !app.bindAndValidate(c, &request) {
+			return
+		}
+
+		secret, hash, err := tokens.NewAPIKey()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+			return
+		}
+
+		key := models.APIKey{
+			KeyID:     primitive.NewObjectID(),
+			Name:      request.Name,
+			Prefix:    secret[:len(tokens.APIKeyPrefix)+6],
+			KeyHash:   hash,
+			Scopes:    request.Scopes,
+			CreatedBy: c.GetString("uid"),
+			CreatedAt: time.Now(),
+		}
+		if request.ExpiresIn != "" {
+			ttl, err := time.ParseDuration(request.ExpiresIn)
+			if err != nil || ttl <= 0 {
+				c.JSON(http.StatusBadRequest, errorBody(c, "expires_in must be a positive duration such as 720h"))
+				return
+			}
+			expiresAt := key.CreatedAt.Add(ttl)
+			key.ExpiresAt = &expiresAt
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		if err = app.apiKeys.CreateAPIKey(ctx, &key); err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"api_key": key, "key": secret})
+	}
+}
+
+func (app *Application) ListAPIKeys() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		keys, err := app.apiKeys.ListAPIKeys(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
+		}
+
+		c.JSON(http.StatusOK, keys)
+	}
+}
+
+func (app *Application) RevokeAPIKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keyID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, "invalid key id"))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		err = app.apiKeys.RevokeAPIKey(ctx, keyID)
+		if errors.Is(err, database.ErrCantFindAPIKey) {
+			c.JSON(http.StatusNotFound, errorBody(c, err.Error()))
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
+		}
+
+		c.JSON(http.StatusOK, "API key revoked")
+	}
+}
@@ -4,91 +4,146 @@ import (
 	"context"
 	"errors"
 	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
 	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/keyring"
+	"github.com/koinav/ecommerce/metrics"
 	"github.com/koinav/ecommerce/models"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/koinav/ecommerce/money"
+	"github.com/koinav/ecommerce/postal"
+	"github.com/koinav/ecommerce/shipping"
+	"github.com/koinav/ecommerce/tokens"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"log"
 	"net/http"
 	"time"
 )
 
 type Application struct {
-	prodCollection *mongo.Collection
-	userCollection *mongo.Collection
+	users            database.UserRepository
+	products         database.ProductRepository
+	carts            database.CartRepository
+	orders           database.OrderRepository
+	shipments        database.ShipmentRepository
+	oneTimeTokens    database.OneTimeTokenRepository
+	sessions         database.SessionRepository
+	apiKeys          database.APIKeyRepository
+	issuer           *tokens.Issuer
+	keys             *keyring.Ring
+	pricing          *database.Pricing
+	addressLimit     int
+	addressValidator *postal.Validator
+	accountMail      *AccountMail
+	security         *Security
+	oidcLogin        *OIDCLogin
+	metrics          *metrics.Metrics
+	background       func(work func(ctx context.Context))
+	validate         *validator.Validate
+	dummyHash        func() string
 }
 
-func NewApp(prodCollection, userCollection *mongo.Collection) *Application {
+// Services is what the handlers depend on. OIDCLogin may be nil when
+// external login is not configured. Background runs work after the response
+// has been sent.
+type Services struct {
+	Users            database.UserRepository
+	Products         database.ProductRepository
+	Carts            database.CartRepository
+	Orders           database.OrderRepository
+	Shipments        database.ShipmentRepository
+	OneTimeTokens    database.OneTimeTokenRepository
+	Sessions         database.SessionRepository
+	APIKeys          database.APIKeyRepository
+	Issuer           *tokens.Issuer
+	Keys             *keyring.Ring
+	Pricing          *database.Pricing
+	AddressLimit     int
+	AddressValidator *postal.Validator
+	AccountMail      *AccountMail
+	Security         *Security
+	OIDCLogin        *OIDCLogin
+	Metrics          *metrics.Metrics
+	Background       func(work func(ctx context.Context))
+}
+
+func NewApp(services Services) *Application {
 	return &Application{
-		prodCollection: prodCollection,
-		userCollection: userCollection,
+		users:            services.Users,
+		products:         services.Products,
+		carts:            services.Carts,
+		orders:           services.Orders,
+		shipments:        services.Shipments,
+		oneTimeTokens:    services.OneTimeTokens,
+		sessions:         services.Sessions,
+		apiKeys:          services.APIKeys,
+		issuer:           services.Issuer,
+		keys:             services.Keys,
+		pricing:          services.Pricing,
+		addressLimit:     services.AddressLimit,
+		addressValidator: services.AddressValidator,
+		accountMail:      services.AccountMail,
+		security:         services.Security,
+		oidcLogin:        services.OIDCLogin,
+		metrics:          services.Metrics,
+		background:       services.Background,
+		validate:         validator.New(),
+		dummyHash:        newDummyHash(services.Security.BcryptCost),
 	}
 }
 
+// AddToCart adds a product to the cart of the authenticated user.
 func (app *Application) AddToCart() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		productQueryID := c.Query("productID")
 		if productQueryID == "" {
-			c.JSON(http.StatusBadRequest, errors.New("productID is not set"))
-			c.Abort()
-			return
-		}
-
-		userQueryID := c.Query("userID")
-		if userQueryID == "" {
-			c.JSON(http.StatusBadRequest, errors.New("userID is not set"))
+			c.JSON(http.StatusBadRequest, errorBody(c, "productID is not set"))
 			c.Abort()
 			return
 		}
 
 		productID, err := primitive.ObjectIDFromHex(productQueryID)
 		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errorBody(c, "internal error"))
 			return
 		}
 
-		var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
 		defer cancel()
 
-		err = database.AddProductToCart(ctx, app.prodCollection, app.userCollection, productID, userQueryID)
+		created, err := database.AddProductToCart(ctx, app.products, app.carts, productID, c.GetString("uid"))
 		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errorBody(c, "internal error"))
 			return
 		}
+		if created {
+			app.metrics.CartCreated()
+		}
 
 		c.JSON(http.StatusOK, "Successfully added to cart")
 	}
 }
 
+// RemoveItem removes a product from the cart of the authenticated user.
 func (app *Application) RemoveItem() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		productQueryID := c.Query("productID")
 		if productQueryID == "" {
-			c.JSON(http.StatusBadRequest, errors.New("productID is not set"))
-			c.Abort()
-			return
-		}
-
-		userQueryID := c.Query("userID")
-		if userQueryID == "" {
-			c.JSON(http.StatusBadRequest, errors.New("userID is not set"))
+			c.JSON(http.StatusBadRequest, errorBody(c, "productID is not set"))
 			c.Abort()
 			return
 		}
 
 		productID, err := primitive.ObjectIDFromHex(productQueryID)
 		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errorBody(c, "internal error"))
 			return
 		}
 
-		var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
 		defer cancel()
 
-		err = database.RemoveCartItem(ctx, app.prodCollection, app.userCollection, productID, userQueryID)
+		err = app.carts.RemoveItem(ctx, c.GetString("uid"), productID)
 		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errorBody(c, "internal error"))
 			return
 		}
 		c.JSON(http.StatusOK, "Item removed Successfully")
@@ -96,101 +151,175 @@ func (app *Application) RemoveItem() gin.HandlerFunc {
 	}
 }
 
-func GetUserCart() gin.HandlerFunc {
+// GetUserCart lists the cart of the authenticated user, taxed for their
+// default shipping address.
+func (app *Application) GetUserCart() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID := c.Query("userID")
-		if userID == "" {
-			c.JSON(http.StatusBadRequest, errors.New("userID is not set"))
-			c.Abort()
-			return
-		}
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 100*time.Second)
+		defer cancel()
 
-		id, err := primitive.ObjectIDFromHex(userID)
-		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
+		cart, err := app.users.GetUser(ctx, c.GetString("uid"))
+		if errors.Is(err, database.ErrUserIdIsNotValid) {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errorBody(c, "internal error"))
 			return
 		}
-
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-		defer cancel()
-
-		var cart models.User
-		err = UserCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}).Decode(&cart)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, "not found")
+			c.JSON(http.StatusInternalServerError, errorBody(c, "not found"))
 			return
 		}
 
-		filterMatch := bson.D{{Key: "$match", Value: bson.D{primitive.E{Key: "_id", Value: id}}}}
-		unwind := bson.D{{Key: "$unwind", Value: bson.D{primitive.E{Key: "path", Value: "$user_cart"}}}}
-		grouping := bson.D{{Key: "$group", Value: bson.D{primitive.E{Key: "_id", Value: "$_id"}, {Key: "total", Value: bson.D{primitive.E{Key: "$sum", Value: "$user_cart.price"}}}}}}
-		pointCursor, err := UserCollection.Aggregate(ctx, mongo.Pipeline{filterMatch, unwind, grouping})
+		address := database.DefaultAddress(&cart, models.AddressShipping)
+		items, totals, err := app.pricing.CartTotals(ctx, cart.UserCart, address, c.GetString("currency"))
 		if err != nil {
-			log.Println(err)
-		}
-
-		var listing []bson.M
-		if err := pointCursor.All(ctx, &listing); err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
 		}
 
-		for _, json := range listing {
-			c.JSON(http.StatusOK, json["total"])
-			c.JSON(http.StatusOK, cart.UserCart)
-		}
+		c.JSON(http.StatusOK, gin.H{
+			"items":        items,
+			"subtotal":     totals.Subtotal,
+			"tax":          totals.Tax,
+			"tax_included": totals.Included,
+			"tax_lines":    totals.Lines,
+			"total":        totals.Total,
+		})
 	}
 }
 
+// BuyFromCart places an order for the cart of the authenticated user, the
+// account middleware.VerifiedEmail checks.
 func (app *Application) BuyFromCart() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userQueryID := c.Query("userID")
-		if userQueryID == "" {
-			c.JSON(http.StatusBadRequest, errors.New("userID is not set"))
-			c.Abort()
+		checkout, ok := app.checkoutOptions(c)
+		if !ok {
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request.Context()), 100*time.Second)
 		defer cancel()
 
-		err := database.BuyItemFromCart(ctx, app.userCollection, userQueryID)
+		order, err := database.BuyItemFromCart(ctx, app.users, app.orders, app.pricing, checkout, c.GetString("uid"))
+		if checkoutError(c, err) {
+			return
+		}
 		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+			return
 		}
+		app.metrics.OrderPlaced("cart", order.Price)
 
 		c.JSON(http.StatusOK, "Order placed successfully")
 	}
 }
 
+// InstantBuy places an order of one product for the authenticated user.
 func (app *Application) InstantBuy() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		productQueryID := c.Query("productID")
 		if productQueryID == "" {
-			c.JSON(http.StatusBadRequest, errors.New("productID is not set"))
+			c.JSON(http.StatusBadRequest, errorBody(c, "productID is not set"))
 			c.Abort()
 			return
 		}
 
-		userQueryID := c.Query("userID")
-		if userQueryID == "" {
-			c.JSON(http.StatusBadRequest, errors.New("userID is not set"))
-			c.Abort()
+		productID, err := primitive.ObjectIDFromHex(productQueryID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errorBody(c, "internal error"))
 			return
 		}
 
-		productID, err := primitive.ObjectIDFromHex(productQueryID)
-		if err != nil {
-			c.AbortWithStatus(http.StatusInternalServerError)
+		checkout, ok := app.checkoutOptions(c)
+		if !ok {
 			return
 		}
 
-		var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
 		defer cancel()
 
-		err = database.InstantBuy(ctx, app.prodCollection, app.userCollection, productID, userQueryID)
+		order, err := database.InstantBuy(ctx, app.products, app.users, app.orders, app.pricing, checkout, productID, c.GetString("uid"))
+		if checkoutError(c, err) {
+			return
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, err)
+			c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+			return
 		}
+		app.metrics.OrderPlaced("instant", order.Price)
 		c.JSON(http.StatusOK, "Order placed successfully")
 	}
 }
+
+type checkoutRequest struct {
+	ShippingMethod    string          `json:"shipping_method"`
+	ShippingAddressID string          `json:"shipping_address_id"`
+	BillingAddressID  string          `json:"billing_address_id"`
+	ShippingAddress   *models.Address `json:"shipping_address"`
+	BillingAddress    *models.Address `json:"billing_address"`
+}
+
+// checkoutOptions reads the buyer's choices from the query string and, for
+// POST requests, from the JSON body, which may carry one-off addresses.
+func (app *Application) checkoutOptions(c *gin.Context) (database.Checkout, bool) {
+	request := checkoutRequest{
+		ShippingMethod:    c.Query("shippingMethod"),
+		ShippingAddressID: c.Query("shippingAddressID"),
+		BillingAddressID:  c.Query("billingAddressID"),
+	}
+
+	if c.Request.Method == http.MethodPost && c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return database.Checkout{}, false
+		}
+	}
+
+	checkout := database.Checkout{
+		Currency:        c.GetString("currency"),
+		ShippingMethod:  request.ShippingMethod,
+		ShippingAddress: request.ShippingAddress,
+		BillingAddress:  request.BillingAddress,
+	}
+
+	for _, inline := range []*models.Address{checkout.ShippingAddress, checkout.BillingAddress} {
+		if inline == nil {
+			continue
+		}
+		inline.AddressID = primitive.NilObjectID
+		if !app.checkAddress(c, inline) {
+			return database.Checkout{}, false
+		}
+	}
+
+	var err error
+	if request.ShippingAddressID != "" {
+		if checkout.ShippingAddressID, err = primitive.ObjectIDFromHex(request.ShippingAddressID); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, "invalid shippingAddressID"))
+			return database.Checkout{}, false
+		}
+	}
+	if request.BillingAddressID != "" {
+		if checkout.BillingAddressID, err = primitive.ObjectIDFromHex(request.BillingAddressID); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, "invalid billingAddressID"))
+			return database.Checkout{}, false
+		}
+	}
+
+	return checkout, true
+}
+
+func checkoutError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, shipping.ErrMethodNotAvailable), errors.Is(err, money.ErrOverflow),
+		errors.Is(err, database.ErrShippingAddressRequired), errors.Is(err, database.ErrEmptyCart):
+		c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+		return true
+	case errors.Is(err, database.ErrCantFindAddress):
+		c.JSON(http.StatusNotFound, errorBody(c, err.Error()))
+		return true
+	case errors.Is(err, database.ErrCartChanged):
+		c.JSON(http.StatusConflict, errorBody(c, err.Error()))
+		return true
+	}
+
+	return false
+}
@@ -2,35 +2,57 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/go-playground/validator/v10"
 	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/logging"
 	"github.com/koinav/ecommerce/models"
-	"github.com/koinav/ecommerce/tokens"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/crypto/bcrypt"
-	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
-var (
-	UserCollection    = database.UserData(database.Client, "Users")
-	ProductCollection = database.ProductData(database.Client, "Products")
-	Validate          = validator.New()
-)
+var errPasswordTooLong = errors.New("password is too long")
 
-func hashPassword(password string) string {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+// hashPassword fails with errPasswordTooLong for passwords bcrypt cannot
+// take: validation allows 72 characters, but bcrypt takes 72 bytes, which
+// characters outside ASCII run over.
+func (app *Application) hashPassword(ctx context.Context, password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), app.security.BcryptCost)
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return "", errPasswordTooLong
+	}
 	if err != nil {
-		log.Panic(err)
+		logging.FromContext(ctx).Error("cannot hash password", "error", err)
+		return "", err
+	}
+
+	return string(hashed), nil
+}
+
+func passwordError(c *gin.Context, err error) {
+	if errors.Is(err, errPasswordTooLong) {
+		c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+		return
 	}
 
-	return string(bytes)
+	c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+}
+
+// newDummyHash returns the hash LogIn checks the passwords of unknown emails
+// against. It is made once, at the cost of real passwords.
+func newDummyHash(cost int) func() string {
+	return sync.OnceValue(func() string {
+		hashed, err := bcrypt.GenerateFromPassword([]byte("not the password of anyone"), cost)
+		if err != nil {
+			return ""
+		}
+		return string(hashed)
+	})
 }
 
 func verifyPassword(userPassword string, givenPassword string) (bool, error) {
@@ -46,53 +68,45 @@ func verifyPassword(userPassword string, givenPassword string) (bool, error) {
 	return valid, myErr
 }
 
-func SignUp() gin.HandlerFunc {
+// errorBody is the JSON of an error response. Clients can quote the request
+// ID to find the logs of the request.
+func errorBody(c *gin.Context, message string) gin.H {
+	return gin.H{"error": message, "request_id": c.GetString("request_id")}
+}
+
+func (app *Application) SignUp() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 100*time.Second)
 		defer cancel()
 
 		var user models.User
 		if err := c.BindJSON(&user); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-
-		if err := Validate.Struct(user); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-
-		count, err := UserCollection.CountDocuments(ctx, bson.M{"email": user.Email})
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err})
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
 			return
 		}
 
-		if count > 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "user already exists"})
+		if err := app.validate.Struct(user); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
 			return
 		}
 
-		count, err = UserCollection.CountDocuments(ctx, bson.M{"phone": user.Phone})
+		hashed, err := app.hashPassword(ctx, user.Password)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err})
+			passwordError(c, err)
 			return
 		}
-
-		if count > 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "user already exists"})
-			return
-		}
-
-		user.Password = hashPassword(user.Password)
+		user.Password = hashed
 
 		user.CreatedAt, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
 		user.UpdatedAt = user.CreatedAt
 		user.ID = primitive.NewObjectID()
 		user.UserID = user.ID.Hex()
-		token, refreshToken, err := tokens.TokenGenerator(user.Email, user.FirstName, user.LastName, user.UserID)
+		user.Role = models.RoleUser
+		user.EmailVerified = false
+		user.TwoFactorEnabled = false
+		token, refreshToken, err := app.issuer.TokenGenerator(user.Email, user.FirstName, user.LastName, user.UserID, user.Role, "", false)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
 			return
 		}
 
@@ -102,71 +116,160 @@ func SignUp() gin.HandlerFunc {
 		user.AddressDetails = make([]models.Address, 0)
 		user.OrderStatus = make([]models.Order, 0)
 
-		_, err = UserCollection.InsertOne(ctx, user)
+		err = app.users.CreateUser(ctx, &user)
+		if errors.Is(err, database.ErrEmailTaken) || errors.Is(err, database.ErrPhoneTaken) {
+			c.JSON(http.StatusBadRequest, errorBody(c, "user already exists"))
+			return
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "user was not created"})
+			c.JSON(http.StatusInternalServerError, errorBody(c, "user was not created"))
+			return
+		}
+		app.metrics.Signup("password")
+
+		// The account is usable without the email, the link can be resent later.
+		if err = app.sendVerification(ctx, &user); err != nil {
+			logging.FromContext(ctx).Error("cannot send verification email", "error", err)
 		}
 
 		c.JSON(http.StatusCreated, "Successfully signed up!")
 	}
 }
 
-func LogIn() gin.HandlerFunc {
+func (app *Application) LogIn() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 100*time.Second)
 		defer cancel()
 
-		var user, foundUser models.User
+		var user models.User
 		if err := c.BindJSON(&user); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		if app.ipBlocked(c) {
 			return
 		}
 
-		err := UserCollection.FindOne(ctx, bson.M{"email": user.Email}).Decode(&foundUser)
+		foundUser, err := app.users.FindUserByEmail(ctx, user.Email)
+		if errors.Is(err, database.ErrCantFindUser) {
+			// The password is checked all the same, so that unknown emails
+			// take as long to answer as known ones.
+			_, _ = verifyPassword(user.Password, app.dummyHash())
+			app.loginFailed(ctx, c, nil, "login or password incorrect")
+			return
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "login or password incorrect"})
+			c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
 			return
 		}
-		defer cancel()
 
-		isValid, msg := verifyPassword(user.Password, foundUser.Password)
+		isValid, _ := verifyPassword(user.Password, foundUser.Password)
+		// A locked account answers like an unknown one and its failures are
+		// not counted; the owner has been mailed the unlock link.
+		if time.Until(foundUser.LockedUntil) > 0 {
+			app.loginFailed(ctx, c, nil, "login or password incorrect")
+			return
+		}
 		if !isValid {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "msg"})
-			fmt.Println(msg)
+			logging.FromContext(ctx).Info("wrong password", "user_id", foundUser.UserID)
+			app.loginFailed(ctx, c, &foundUser, "login or password incorrect")
 			return
 		}
 
-		token, refreshToken, err := tokens.TokenGenerator(foundUser.Email, foundUser.FirstName, foundUser.LastName, foundUser.UserID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		if foundUser.TwoFactorEnabled {
+			preAuthToken, err := app.issuer.PreAuthToken(foundUser.UserID, app.security.PreAuthTTL)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"two_factor_required": true,
+				"pre_auth_token":      preAuthToken,
+			})
 			return
 		}
 
-		err = tokens.UpdateAllTokens(token, refreshToken, foundUser.UserID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
-			return
+		app.issueTokens(ctx, c, &foundUser, false)
+	}
+}
+
+// issueTokens finishes a login by opening a session for the device, handing
+// out a fresh token pair for it and forgetting the failed attempts of the
+// account.
+func (app *Application) issueTokens(ctx context.Context, c *gin.Context, user *models.User, twoFactor bool) {
+	if user.FailedLogins > 0 {
+		if err := app.users.UnlockAccount(ctx, user.UserID); err != nil {
+			logging.FromContext(ctx).Error("cannot unlock account after login", "error", err)
 		}
+	}
+
+	session, err := app.sessions.CreateSession(ctx, user.UserID,
+		c.Request.UserAgent(), c.ClientIP(), app.issuer.RefreshTTL())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+		return
+	}
+
+	token, refreshToken, err := app.issuer.TokenGenerator(user.Email, user.FirstName, user.LastName, user.UserID, user.Role,
+		session.SessionID.Hex(), twoFactor)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+		return
+	}
 
-		c.JSON(http.StatusFound, foundUser)
+	err = app.users.UpdateTokens(ctx, user.UserID, token, refreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+		return
 	}
+
+	app.metrics.Login()
+	c.JSON(http.StatusOK, gin.H{
+		"user":          profileOf(user),
+		"token":         token,
+		"refresh_token": refreshToken,
+	})
+}
+
+// productRequest takes the price apart from the product, as a bare number is
+// read in the legacy currency of the shop.
+type productRequest struct {
+	models.Product
+	Price json.RawMessage `json:"price"`
 }
 
-func ProductViewerAdmin() gin.HandlerFunc {
+func (app *Application) ProductViewerAdmin() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 100*time.Second)
 		defer cancel()
-		var product models.Product
+		var request productRequest
+
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		product := request.Product
+		if request.Price != nil {
+			price, err := app.pricing.Legacy.ParseJSON(request.Price)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+				return
+			}
+			product.Price = price
+		}
 
-		if err := c.BindJSON(&product); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if product.Price.IsNegative() {
+			c.JSON(http.StatusBadRequest, errorBody(c, "price cannot be negative"))
 			return
 		}
 
 		product.ProductID = primitive.NewObjectID()
-		_, err := ProductCollection.InsertOne(ctx, product)
+		err := app.products.AddProduct(ctx, &product)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "not inserted"})
+			c.JSON(http.StatusInternalServerError, errorBody(c, "not inserted"))
 			return
 		}
 
@@ -174,14 +277,20 @@ func ProductViewerAdmin() gin.HandlerFunc {
 	}
 }
 
-func ViewProducts() gin.HandlerFunc {
+func (app *Application) ViewProducts() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 100*time.Second)
 		defer cancel()
 
-		var productList, err = getAllProducts(ctx)
+		var productList, err = app.products.ListProducts(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+			return
+		}
+
+		productList, err = app.pricing.ConvertProducts(ctx, productList, c.GetString("currency"))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
 			return
 		}
 
@@ -189,22 +298,22 @@ func ViewProducts() gin.HandlerFunc {
 	}
 }
 
-func SearchProductByQuery() gin.HandlerFunc {
+func (app *Application) SearchProductByQuery() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		queryParam := c.Query("name")
 		if queryParam == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid search index"})
+			c.JSON(http.StatusBadRequest, errorBody(c, "Invalid search index"))
 			c.Abort()
 			return
 		}
 		queryParam = strings.ToLower(queryParam)
 
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 100*time.Second)
 		defer cancel()
 
-		var productList, err = getAllProducts(ctx)
+		var productList, err = app.products.ListProducts(ctx)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
 			return
 		}
 
@@ -216,26 +325,12 @@ func SearchProductByQuery() gin.HandlerFunc {
 			}
 		}
 
-		c.JSON(http.StatusOK, &searchResults)
-	}
-}
-
-func getAllProducts(ctx context.Context) ([]models.Product, error) {
-	var productList []models.Product
-
-	cursor, err := ProductCollection.Find(ctx, bson.D{})
-	if err != nil {
-		return nil, err
-	}
-
-	err = cursor.All(ctx, &productList)
-	if err != nil {
-		return nil, err
-	}
+		searchResults, err = app.pricing.ConvertProducts(ctx, searchResults, c.GetString("currency"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
+		}
 
-	if err := cursor.Err(); err != nil {
-		return nil, err
+		c.JSON(http.StatusOK, &searchResults)
 	}
-
-	return productList, nil
 }
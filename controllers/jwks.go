@@ -0,0 +1,16 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// JWKS publishes the public keys tokens are verified with, for other
+// services that accept our tokens.
+func (app *Application) JWKS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, app.keys.JWKS(time.Now()))
+	}
+}
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/mail"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/tokens"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ipBlocked answers 429 when the client IP is backing off after too many
+// failed logins.
+func (app *Application) ipBlocked(c *gin.Context) bool {
+	wait, blocked := app.security.IPBackoff.Blocked(c.ClientIP())
+	if !blocked {
+		return false
+	}
+
+	tooManyAttempts(c, wait)
+	return true
+}
+
+// accountLocked answers 429 for a locked account before the second factor or
+// an external login goes any further. LogIn answers locked accounts like
+// wrong passwords instead, as a 429 there would tell which emails exist.
+func (app *Application) accountLocked(c *gin.Context, user *models.User) bool {
+	wait := time.Until(user.LockedUntil)
+	if wait <= 0 {
+		return false
+	}
+
+	tooManyAttempts(c, wait)
+	return true
+}
+
+// loginFailed counts the failure against the client IP and, if known, the
+// account, and mails an unlock link to the owner when the account gets locked.
+func (app *Application) loginFailed(ctx context.Context, c *gin.Context, user *models.User, message string) {
+	app.security.IPBackoff.Fail(c.ClientIP())
+	app.metrics.FailedLogin()
+
+	if user != nil {
+		lockedUntil, locked, err := app.users.RecordLoginFailure(ctx, user, app.security.AccountLockout)
+		if err != nil {
+			logging.FromContext(ctx).Error("cannot record login failure", "error", err)
+		}
+		if locked {
+			if err = app.sendUnlockLink(ctx, user, lockedUntil); err != nil {
+				logging.FromContext(ctx).Error("cannot send unlock link", "error", err)
+			}
+		}
+	}
+
+	c.JSON(http.StatusUnauthorized, errorBody(c, message))
+}
+
+func (app *Application) sendUnlockLink(ctx context.Context, user *models.User, lockedUntil time.Time) error {
+	token, hash, err := tokens.NewOneTimeToken()
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot issue unlock token", "error", err)
+		return database.ErrCantIssueToken
+	}
+
+	err = app.oneTimeTokens.SaveOneTimeToken(ctx, user.UserID, user.Email, models.PurposeAccountUnlock, hash, app.accountMail.UnlockTTL)
+	if err != nil {
+		return err
+	}
+
+	return app.accountMail.Sender.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Your account has been locked",
+		Body: fmt.Sprintf("Hello, %s!\n\nThere were too many failed attempts to log in to your account, so it is locked until %s.\n"+
+			"If it was you, unlock it now with the link below. If it was not, consider changing your password.\n\n%s\n",
+			user.FirstName, lockedUntil.Format(time.RFC1123), linkWithToken(app.accountMail.UnlockURL, token)),
+	})
+}
+
+func (app *Application) UnlockAccount() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			c.JSON(http.StatusBadRequest, errorBody(c, "token is not set"))
+			c.Abort()
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		consumed, err := app.oneTimeTokens.ConsumeOneTimeToken(ctx,
+			models.PurposeAccountUnlock, tokens.HashOneTimeToken(token))
+		if errors.Is(err, database.ErrInvalidOneTimeToken) {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
+		}
+
+		if err = app.users.UnlockAccount(ctx, consumed.UserID); err != nil {
+			profileError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, "Account unlocked")
+	}
+}
+
+func (app *Application) AdminUnlockUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.Query("userID")
+		if userID == "" {
+			c.JSON(http.StatusNotFound, errorBody(c, "invalid userID"))
+			c.Abort()
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		if err := app.users.UnlockAccount(ctx, userID); err != nil {
+			profileError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, "Account unlocked")
+	}
+}
+
+func tooManyAttempts(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, errorBody(c, "too many failed attempts, try again later"))
+}
@@ -0,0 +1,316 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/oauth2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	oidcCookie    = "oidc_login"
+	oidcCookieTTL = 10 * time.Minute
+)
+
+// OIDCLogin signs users in with an external OpenID Connect provider using
+// the authorization code flow with PKCE.
+type OIDCLogin struct {
+	issuer   string
+	config   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	secure   bool
+}
+
+// NewOIDCLogin discovers the provider configuration from the issuer.
+func NewOIDCLogin(ctx context.Context, issuer, clientID, clientSecret, redirectURL string, scopes []string) (*OIDCLogin, error) {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCLogin{
+		issuer: issuer,
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirectURL,
+			Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+		secure:   strings.HasPrefix(redirectURL, "https://"),
+	}, nil
+}
+
+// oidcFlow is what the browser carries between the redirect to the provider
+// and the callback.
+type oidcFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+type oidcClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+	Name          string `json:"name"`
+}
+
+func (app *Application) OIDCStart() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if app.oidcLogin == nil {
+			c.JSON(http.StatusNotFound, errorBody(c, "external login is not configured"))
+			return
+		}
+
+		state, err := randomString()
+		if err != nil {
+			logging.FromContext(c.Request.Context()).Error("cannot generate OIDC state", "error", err)
+			c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+			return
+		}
+		nonce, err := randomString()
+		if err != nil {
+			logging.FromContext(c.Request.Context()).Error("cannot generate OIDC nonce", "error", err)
+			c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+			return
+		}
+
+		flow := oidcFlow{
+			State:    state,
+			Nonce:    nonce,
+			Verifier: oauth2.GenerateVerifier(),
+		}
+
+		cookie, err := json.Marshal(flow)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+			return
+		}
+
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(oidcCookie, base64.RawURLEncoding.EncodeToString(cookie), int(oidcCookieTTL/time.Second),
+			"/users/oidc", "", app.oidcLogin.secure, true)
+
+		c.Redirect(http.StatusFound, app.oidcLogin.config.AuthCodeURL(flow.State,
+			oidc.Nonce(flow.Nonce), oauth2.S256ChallengeOption(flow.Verifier)))
+	}
+}
+
+// OIDCCallback finishes the external login: the provider subject is looked up
+// among linked identities, then by a verified email, and a new account is
+// created if neither is found.
+func (app *Application) OIDCCallback() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if app.oidcLogin == nil {
+			c.JSON(http.StatusNotFound, errorBody(c, "external login is not configured"))
+			return
+		}
+
+		if providerError := c.Query("error"); providerError != "" {
+			body := errorBody(c, providerError)
+			body["description"] = c.Query("error_description")
+			c.JSON(http.StatusUnauthorized, body)
+			return
+		}
+
+		flow, ok := readOIDCFlow(c)
+		c.SetCookie(oidcCookie, "", -1, "/users/oidc", "", app.oidcLogin.secure, true)
+		if !ok || subtle.ConstantTimeCompare([]byte(flow.State), []byte(c.Query("state"))) != 1 {
+			c.JSON(http.StatusBadRequest, errorBody(c, "login session is invalid or expired"))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 30*time.Second)
+		defer cancel()
+
+		token, err := app.oidcLogin.config.Exchange(ctx, c.Query("code"), oauth2.VerifierOption(flow.Verifier))
+		if err != nil {
+			logging.FromContext(ctx).Error("OIDC code exchange failed", "error", err)
+			c.JSON(http.StatusUnauthorized, errorBody(c, "cannot exchange the authorization code"))
+			return
+		}
+
+		rawIDToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, errorBody(c, "provider did not return an ID token"))
+			return
+		}
+
+		idToken, err := app.oidcLogin.verifier.Verify(ctx, rawIDToken)
+		if err != nil {
+			logging.FromContext(ctx).Error("OIDC ID token verification failed", "error", err)
+			c.JSON(http.StatusUnauthorized, errorBody(c, "ID token is invalid"))
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(flow.Nonce)) != 1 {
+			c.JSON(http.StatusUnauthorized, errorBody(c, "ID token is invalid"))
+			return
+		}
+
+		var claims oidcClaims
+		if err = idToken.Claims(&claims); err != nil {
+			c.JSON(http.StatusUnauthorized, errorBody(c, "ID token is invalid"))
+			return
+		}
+
+		user, err := app.externalUser(ctx, idToken.Subject, &claims)
+		if err != nil {
+			externalLoginError(c, err)
+			return
+		}
+		if app.accountLocked(c, &user) {
+			return
+		}
+
+		if user.TwoFactorEnabled {
+			preAuthToken, err := app.issuer.PreAuthToken(user.UserID, app.security.PreAuthTTL)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"two_factor_required": true,
+				"pre_auth_token":      preAuthToken,
+			})
+			return
+		}
+
+		app.issueTokens(ctx, c, &user, false)
+	}
+}
+
+var errEmailNotVerifiedByProvider = errors.New("an account with this email exists, log in with the password")
+
+func (app *Application) externalUser(ctx context.Context, subject string, claims *oidcClaims) (models.User, error) {
+	issuer := app.oidcLogin.issuer
+
+	user, err := app.users.FindUserByIdentity(ctx, issuer, subject)
+	if err == nil {
+		return user, nil
+	}
+	// Any other failure must not be taken for a new subject.
+	if !errors.Is(err, database.ErrCantFindUser) {
+		return models.User{}, err
+	}
+
+	identity := models.ExternalIdentity{
+		Issuer:   issuer,
+		Subject:  subject,
+		Email:    claims.Email,
+		LinkedAt: time.Now(),
+	}
+
+	if claims.Email != "" {
+		user, err = app.users.FindUserByEmail(ctx, claims.Email)
+		if err != nil && !errors.Is(err, database.ErrCantFindUser) {
+			return models.User{}, err
+		}
+		if err == nil {
+			// Only the provider's word that the address is theirs lets a
+			// stranger's subject into an existing account.
+			if !claims.EmailVerified {
+				return models.User{}, errEmailNotVerifiedByProvider
+			}
+			if err = app.users.LinkIdentity(ctx, &user, identity); err != nil {
+				return models.User{}, err
+			}
+			return user, nil
+		}
+	}
+
+	firstName, lastName := claims.GivenName, claims.FamilyName
+	if firstName == "" && lastName == "" {
+		firstName, lastName, _ = strings.Cut(claims.Name, " ")
+	}
+
+	// Nobody knows this password; the owner can set one by resetting it.
+	password, err := randomString()
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot generate password", "error", err)
+		return models.User{}, err
+	}
+	password, err = app.hashPassword(ctx, password)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	now, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	user = models.User{
+		ID:             primitive.NewObjectID(),
+		FirstName:      firstName,
+		LastName:       lastName,
+		Password:       password,
+		Email:          claims.Email,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		Role:           models.RoleUser,
+		EmailVerified:  claims.Email != "" && claims.EmailVerified,
+		Identities:     []models.ExternalIdentity{identity},
+		UserCart:       make([]models.ProductInCart, 0),
+		AddressDetails: make([]models.Address, 0),
+		OrderStatus:    make([]models.Order, 0),
+	}
+	user.UserID = user.ID.Hex()
+
+	if err = app.users.CreateUser(ctx, &user); err != nil {
+		return models.User{}, err
+	}
+	app.metrics.Signup("oidc")
+
+	return user, nil
+}
+
+func readOIDCFlow(c *gin.Context) (oidcFlow, bool) {
+	var flow oidcFlow
+
+	cookie, err := c.Cookie(oidcCookie)
+	if err != nil {
+		return flow, false
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cookie)
+	if err != nil {
+		return flow, false
+	}
+
+	if err = json.Unmarshal(raw, &flow); err != nil || flow.State == "" {
+		return flow, false
+	}
+
+	return flow, true
+}
+
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func externalLoginError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errEmailNotVerifiedByProvider), errors.Is(err, database.ErrEmailTaken),
+		errors.Is(err, database.ErrPhoneTaken), errors.Is(err, database.ErrIdentityTaken):
+		c.JSON(http.StatusConflict, errorBody(c, err.Error()))
+	default:
+		c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+	}
+}
@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/mail"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/tokens"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// AccountMail holds what is needed to email links to users. The links are
+// built by appending the token as a query parameter to the configured URLs.
+type AccountMail struct {
+	Sender         mail.Sender
+	ResetURL       string
+	ResetTTL       time.Duration
+	VerifyURL      string
+	VerifyTTL      time.Duration
+	ResendInterval time.Duration
+	UnlockURL      string
+	UnlockTTL      time.Duration
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email" validate:"email,required"`
+}
+
+type resetPasswordRequest struct {
+	Token       string `json:"token" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required,min=6,max=72"`
+}
+
+// ForgotPassword answers the same way whether the email is known or not, so
+// that it cannot be used to find out who has an account. The lookup and the
+// email run after the response, so its timing tells nothing either.
+func (app *Application) ForgotPassword() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request forgotPasswordRequest
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		if err := app.validate.Struct(request); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		logger := logging.FromContext(c.Request.Context())
+		app.background(func(ctx context.Context) {
+			ctx, cancel := context.WithTimeout(logging.NewContext(ctx, logger), 30*time.Second)
+			defer cancel()
+
+			app.sendPasswordReset(ctx, request.Email)
+		})
+
+		c.JSON(http.StatusOK, "If the account exists, a reset link has been sent")
+	}
+}
+
+// sendPasswordReset emails a reset link if the email has an account. Nobody
+// waits for it, so it only logs what went wrong.
+func (app *Application) sendPasswordReset(ctx context.Context, email string) {
+	user, err := app.users.FindUserByEmail(ctx, email)
+	if errors.Is(err, database.ErrCantFindUser) {
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot find the user for a password reset", "error", err)
+		return
+	}
+
+	token, hash, err := tokens.NewOneTimeToken()
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot issue password reset token", "error", err)
+		return
+	}
+
+	err = app.oneTimeTokens.SaveOneTimeToken(ctx, user.UserID, user.Email, models.PurposePasswordReset, hash, app.accountMail.ResetTTL)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot save password reset token", "error", err)
+		return
+	}
+
+	err = app.accountMail.Sender.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Password reset",
+		Body: fmt.Sprintf("Hello, %s!\n\nTo set a new password follow the link below. It is valid for %s.\n\n%s\n\n"+
+			"If you did not ask for a reset, ignore this email.\n",
+			user.FirstName, app.accountMail.ResetTTL, linkWithToken(app.accountMail.ResetURL, token)),
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot send password reset email", "error", err)
+	}
+}
+
+func (app *Application) ResetPassword() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request resetPasswordRequest
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		if err := app.validate.Struct(request); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		// Hashed first, so a password bcrypt rejects does not use up the link.
+		hashed, err := app.hashPassword(ctx, request.NewPassword)
+		if err != nil {
+			passwordError(c, err)
+			return
+		}
+
+		consumed, err := app.oneTimeTokens.ConsumeOneTimeToken(ctx,
+			models.PurposePasswordReset, tokens.HashOneTimeToken(request.Token))
+		if errors.Is(err, database.ErrInvalidOneTimeToken) {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
+		}
+
+		if err = app.users.ResetPassword(ctx, consumed.UserID, hashed); err != nil {
+			profileError(c, err)
+			return
+		}
+
+		if err = app.sessions.RevokeAllSessions(ctx, consumed.UserID); err != nil {
+			logging.FromContext(ctx).Error("cannot revoke sessions after password reset", "error", err)
+		}
+
+		c.JSON(http.StatusOK, "Password changed, please log in again")
+	}
+}
+
+func linkWithToken(base, token string) string {
+	link, err := url.Parse(base)
+	if err != nil {
+		return base + "?token=" + url.QueryEscape(token)
+	}
+
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return link.String()
+}
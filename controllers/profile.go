@@ -0,0 +1,225 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/models"
+	"net/http"
+	"time"
+)
+
+type profileUpdate struct {
+	FirstName *string `json:"first_name" validate:"omitempty,min=2,max=30"`
+	LastName  *string `json:"last_name" validate:"omitempty,min=2,max=30"`
+}
+
+type emailChange struct {
+	Email           string `json:"email" validate:"email,required"`
+	CurrentPassword string `json:"current_password" validate:"required"`
+}
+
+type phoneChange struct {
+	Phone string `json:"phone" validate:"required"`
+}
+
+type passwordChange struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,min=6,max=72"`
+}
+
+func profileOf(user *models.User) models.Profile {
+	return models.Profile{
+		UserID:        user.UserID,
+		FirstName:     user.FirstName,
+		LastName:      user.LastName,
+		Email:         user.Email,
+		Phone:         user.Phone,
+		EmailVerified: user.EmailVerified,
+		TwoFactor:     user.TwoFactorEnabled,
+		Role:          user.Role,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+	}
+}
+
+func (app *Application) GetProfile() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		user, err := app.users.GetUser(ctx, c.GetString("uid"))
+		if err != nil {
+			profileError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, profileOf(&user))
+	}
+}
+
+func (app *Application) UpdateProfile() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var update profileUpdate
+		if err := c.BindJSON(&update); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		if err := app.validate.Struct(update); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		uid := c.GetString("uid")
+		user, err := app.users.GetUser(ctx, uid)
+		if err != nil {
+			profileError(c, err)
+			return
+		}
+
+		if update.FirstName != nil {
+			user.FirstName = *update.FirstName
+		}
+		if update.LastName != nil {
+			user.LastName = *update.LastName
+		}
+
+		if err = app.users.UpdateName(ctx, uid, user.FirstName, user.LastName); err != nil {
+			profileError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, profileOf(&user))
+	}
+}
+
+func (app *Application) ChangeEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var change emailChange
+		if err := c.BindJSON(&change); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		if err := app.validate.Struct(change); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 30*time.Second)
+		defer cancel()
+
+		uid := c.GetString("uid")
+		user, err := app.users.GetUser(ctx, uid)
+		if err != nil {
+			profileError(c, err)
+			return
+		}
+
+		if valid, _ := verifyPassword(change.CurrentPassword, user.Password); !valid {
+			c.JSON(http.StatusForbidden, errorBody(c, "current password is incorrect"))
+			return
+		}
+
+		if err = app.users.ChangeEmail(ctx, uid, change.Email); err != nil {
+			profileError(c, err)
+			return
+		}
+
+		user.Email = change.Email
+		user.EmailVerified = false
+		user.VerificationSentAt = time.Time{}
+		if err = app.sendVerification(ctx, &user); err != nil {
+			logging.FromContext(ctx).Error("cannot send verification email", "error", err)
+		}
+
+		c.JSON(http.StatusOK, "Email changed, please confirm the new address")
+	}
+}
+
+func (app *Application) ChangePhone() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var change phoneChange
+		if err := c.BindJSON(&change); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		if err := app.validate.Struct(change); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		if err := app.users.ChangePhone(ctx, c.GetString("uid"), change.Phone); err != nil {
+			profileError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, "Phone changed")
+	}
+}
+
+func (app *Application) ChangePassword() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var change passwordChange
+		if err := c.BindJSON(&change); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		if err := app.validate.Struct(change); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		uid := c.GetString("uid")
+		user, err := app.users.GetUser(ctx, uid)
+		if err != nil {
+			profileError(c, err)
+			return
+		}
+
+		if valid, _ := verifyPassword(change.CurrentPassword, user.Password); !valid {
+			c.JSON(http.StatusForbidden, errorBody(c, "current password is incorrect"))
+			return
+		}
+
+		hashed, err := app.hashPassword(ctx, change.NewPassword)
+		if err != nil {
+			passwordError(c, err)
+			return
+		}
+
+		if err = app.users.ChangePassword(ctx, uid, hashed); err != nil {
+			profileError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, "Password changed")
+	}
+}
+
+func profileError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, database.ErrUserIdIsNotValid):
+		c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+	case errors.Is(err, database.ErrCantFindUser):
+		c.JSON(http.StatusNotFound, errorBody(c, err.Error()))
+	case errors.Is(err, database.ErrEmailTaken), errors.Is(err, database.ErrPhoneTaken):
+		c.JSON(http.StatusConflict, errorBody(c, err.Error()))
+	default:
+		c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+	}
+}
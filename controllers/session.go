@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/database"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"time"
+)
+
+func (app *Application) ListSessions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		sessions, err := app.sessions.ListSessions(ctx, c.GetString("uid"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
+		}
+
+		current := c.GetString("sid")
+		for i := range sessions {
+			sessions[i].Current = sessions[i].SessionID.Hex() == current
+		}
+
+		c.JSON(http.StatusOK, sessions)
+	}
+}
+
+// RevokeSession logs a device out; its tokens stop working at once.
+func (app *Application) RevokeSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionID, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, "invalid session id"))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		err = app.sessions.RevokeSession(ctx, c.GetString("uid"), sessionID)
+		if errors.Is(err, database.ErrCantFindSession) {
+			c.JSON(http.StatusNotFound, errorBody(c, err.Error()))
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
+		}
+
+		c.JSON(http.StatusOK, "Session revoked")
+	}
+}
@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"time"
+)
+
+type lineProgress struct {
+	ProductID   primitive.ObjectID `json:"product_id"`
+	ProductName string             `json:"product_name"`
+	Ordered     int                `json:"ordered"`
+	Shipped     int                `json:"shipped"`
+	Delivered   int                `json:"delivered"`
+}
+
+func (app *Application) CreateShipment() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var shipment models.Shipment
+		if err := c.BindJSON(&shipment); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		if err := app.validate.Struct(shipment); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		err := database.CreateShipment(ctx, app.orders, app.shipments, &shipment)
+		switch {
+		case errors.Is(err, database.ErrCantFindOrder):
+			c.JSON(http.StatusNotFound, errorBody(c, err.Error()))
+			return
+		case errors.Is(err, database.ErrShipmentExceedsOrder):
+			c.JSON(http.StatusConflict, errorBody(c, err.Error()))
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
+		}
+
+		c.JSON(http.StatusCreated, shipment)
+	}
+}
+
+func (app *Application) AddTrackingEvent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		shipmentID, err := primitive.ObjectIDFromHex(c.Query("shipmentID"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, "invalid shipmentID"))
+			return
+		}
+
+		var event models.TrackingEvent
+		if err = c.BindJSON(&event); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		if err = app.validate.Struct(event); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		err = app.shipments.AddTrackingEvent(ctx, shipmentID, event)
+		switch {
+		case errors.Is(err, database.ErrCantFindShipment):
+			c.JSON(http.StatusNotFound, errorBody(c, err.Error()))
+			return
+		case errors.Is(err, database.ErrShipmentAlreadyClosed):
+			c.JSON(http.StatusConflict, errorBody(c, err.Error()))
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
+		}
+
+		c.JSON(http.StatusOK, "Tracking updated")
+	}
+}
+
+// OrderDetails shows an order of the authenticated user with its shipments.
+func (app *Application) OrderDetails() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orderID, err := primitive.ObjectIDFromHex(c.Query("orderID"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, "invalid orderID"))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		order, err := app.orders.GetOrder(ctx, c.GetString("uid"), orderID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, errorBody(c, err.Error()))
+			return
+		}
+
+		shipments, err := app.shipments.OrderShipments(ctx, orderID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
+		}
+
+		lines, status := shipmentProgress(order, shipments)
+		c.JSON(http.StatusOK, gin.H{
+			"order":              order,
+			"shipments":          shipments,
+			"items":              lines,
+			"fulfillment_status": status,
+		})
+	}
+}
+
+func shipmentProgress(order models.Order, shipments []models.Shipment) ([]lineProgress, string) {
+	lines := make([]lineProgress, 0)
+	index := make(map[primitive.ObjectID]int)
+	for _, item := range order.OrderCart {
+		i, ok := index[item.ProductID]
+		if !ok {
+			i = len(lines)
+			index[item.ProductID] = i
+			lines = append(lines, lineProgress{ProductID: item.ProductID, ProductName: item.ProductName})
+		}
+		lines[i].Ordered++
+	}
+
+	for _, shipment := range shipments {
+		for _, item := range shipment.Items {
+			i, ok := index[item.ProductID]
+			if !ok {
+				continue
+			}
+			lines[i].Shipped += item.Quantity
+			if shipment.Status == models.ShipmentDelivered {
+				lines[i].Delivered += item.Quantity
+			}
+		}
+	}
+
+	ordered, shipped, delivered := 0, 0, 0
+	for _, line := range lines {
+		ordered += line.Ordered
+		shipped += line.Shipped
+		delivered += line.Delivered
+	}
+
+	switch {
+	case shipped == 0:
+		return lines, "unfulfilled"
+	case delivered == ordered:
+		return lines, "delivered"
+	case shipped < ordered:
+		return lines, "partially_shipped"
+	}
+
+	return lines, "shipped"
+}
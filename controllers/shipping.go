@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"time"
+)
+
+// ShippingQuote prices the cart of the authenticated user for every
+// shipping method.
+func (app *Application) ShippingQuote() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		user, err := app.users.GetUser(ctx, c.GetString("uid"))
+		if errors.Is(err, database.ErrUserIdIsNotValid) {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusNotFound, errorBody(c, "user not found"))
+			return
+		}
+
+		var address *models.Address
+		if addressQueryID := c.Query("addressID"); addressQueryID != "" {
+			addressID, err := primitive.ObjectIDFromHex(addressQueryID)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, errorBody(c, "invalid addressID"))
+				return
+			}
+
+			for i := range user.AddressDetails {
+				if user.AddressDetails[i].AddressID == addressID {
+					address = &user.AddressDetails[i]
+				}
+			}
+			if address == nil {
+				c.JSON(http.StatusNotFound, errorBody(c, "address not found"))
+				return
+			}
+		} else {
+			address = database.DefaultAddress(&user, models.AddressShipping)
+		}
+
+		currency := c.GetString("currency")
+		items, err := app.pricing.ConvertItems(ctx, user.UserCart, currency)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
+		}
+
+		quotes, err := app.pricing.ShippingRates.Quotes(items, address, currency)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
+		}
+
+		c.JSON(http.StatusOK, quotes)
+	}
+}
@@ -0,0 +1,303 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/ratelimit"
+	"github.com/koinav/ecommerce/tokens"
+	"github.com/koinav/ecommerce/totp"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const recoveryCodeCount = 10
+
+var errInvalidCode = errors.New("invalid two-factor code")
+
+// Security holds the account protection settings.
+type Security struct {
+	BcryptCost int
+	TOTPIssuer string
+	// PreAuthTTL is how long the second login step may take.
+	PreAuthTTL      time.Duration
+	RequireAdmin2FA bool
+	AccountLockout  ratelimit.Policy
+	IPBackoff       *ratelimit.Backoff
+}
+
+type enrollRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+}
+
+type confirmRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type disableRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	Code            string `json:"code" validate:"required_without=RecoveryCode"`
+	RecoveryCode    string `json:"recovery_code"`
+}
+
+type secondFactorLogin struct {
+	PreAuthToken string `json:"pre_auth_token" validate:"required"`
+	Code         string `json:"code" validate:"required_without=RecoveryCode"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// EnrollTwoFactor starts the enrolment; 2FA is turned on only once a code
+// from the new secret is confirmed.
+func (app *Application) EnrollTwoFactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request enrollRequest
+		if !app.bindAndValidate(c, &request) {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		uid := c.GetString("uid")
+		user, err := app.users.GetUser(ctx, uid)
+		if err != nil {
+			profileError(c, err)
+			return
+		}
+
+		if valid, _ := verifyPassword(request.CurrentPassword, user.Password); !valid {
+			c.JSON(http.StatusForbidden, errorBody(c, "current password is incorrect"))
+			return
+		}
+
+		if user.TwoFactorEnabled {
+			c.JSON(http.StatusConflict, errorBody(c, "two-factor authentication is already enabled"))
+			return
+		}
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+			return
+		}
+
+		if err = app.users.SetPendingTOTPSecret(ctx, uid, secret); err != nil {
+			profileError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"secret":      secret,
+			"otpauth_uri": totp.URI(app.security.TOTPIssuer, user.Email, secret),
+		})
+	}
+}
+
+func (app *Application) ConfirmTwoFactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request confirmRequest
+		if !app.bindAndValidate(c, &request) {
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		uid := c.GetString("uid")
+		user, err := app.users.GetUser(ctx, uid)
+		if err != nil {
+			profileError(c, err)
+			return
+		}
+
+		if user.PendingTOTPSecret == "" {
+			c.JSON(http.StatusBadRequest, errorBody(c, database.ErrTwoFactorNotPending.Error()))
+			return
+		}
+
+		counter, ok := totp.Validate(user.PendingTOTPSecret, request.Code, time.Now())
+		if !ok {
+			c.JSON(http.StatusBadRequest, errorBody(c, errInvalidCode.Error()))
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+			return
+		}
+
+		err = app.users.EnableTwoFactor(ctx, uid, user.PendingTOTPSecret, counter, hashes)
+		if err != nil {
+			twoFactorError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+	}
+}
+
+func (app *Application) DisableTwoFactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request disableRequest
+		if !app.bindAndValidate(c, &request) {
+			return
+		}
+
+		if app.security.RequireAdmin2FA && c.GetString("role") == models.RoleAdmin {
+			c.JSON(http.StatusForbidden, errorBody(c, "two-factor authentication is mandatory for admins"))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		uid := c.GetString("uid")
+		user, err := app.users.GetUser(ctx, uid)
+		if err != nil {
+			profileError(c, err)
+			return
+		}
+
+		if valid, _ := verifyPassword(request.CurrentPassword, user.Password); !valid {
+			c.JSON(http.StatusForbidden, errorBody(c, "current password is incorrect"))
+			return
+		}
+
+		if !user.TwoFactorEnabled {
+			c.JSON(http.StatusConflict, errorBody(c, "two-factor authentication is not enabled"))
+			return
+		}
+
+		if err = app.checkSecondFactor(ctx, &user, request.Code, request.RecoveryCode); err != nil {
+			twoFactorError(c, err)
+			return
+		}
+
+		if err = app.users.DisableTwoFactor(ctx, uid); err != nil {
+			profileError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, "Two-factor authentication disabled")
+	}
+}
+
+// LogInSecondFactor is the second login step for users with 2FA: it takes
+// the pre-auth token from LogIn and a TOTP or recovery code.
+func (app *Application) LogInSecondFactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request secondFactorLogin
+		if !app.bindAndValidate(c, &request) {
+			return
+		}
+
+		if app.ipBlocked(c) {
+			return
+		}
+
+		claims, err := app.issuer.ValidatePreAuthToken(request.PreAuthToken)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, errorBody(c, "pre-auth token is invalid or expired"))
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 30*time.Second)
+		defer cancel()
+
+		user, err := app.users.GetUser(ctx, claims.Uid)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, errorBody(c, "pre-auth token is invalid or expired"))
+			return
+		}
+
+		if !user.TwoFactorEnabled || claims.IssuedAt < user.TokensRevokedAt.Unix() {
+			c.JSON(http.StatusUnauthorized, errorBody(c, "pre-auth token is invalid or expired"))
+			return
+		}
+
+		if app.accountLocked(c, &user) {
+			return
+		}
+
+		err = app.checkSecondFactor(ctx, &user, request.Code, request.RecoveryCode)
+		if errors.Is(err, errInvalidCode) || errors.Is(err, database.ErrCodeAlreadyUsed) ||
+			errors.Is(err, database.ErrInvalidRecoveryCode) {
+			app.loginFailed(ctx, c, &user, errInvalidCode.Error())
+			return
+		}
+		if err != nil {
+			twoFactorError(c, err)
+			return
+		}
+
+		app.issueTokens(ctx, c, &user, true)
+	}
+}
+
+func (app *Application) checkSecondFactor(ctx context.Context, user *models.User, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		return app.users.UseRecoveryCode(ctx, user.UserID,
+			tokens.HashOneTimeToken(normalizeRecoveryCode(recoveryCode)))
+	}
+
+	counter, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return errInvalidCode
+	}
+
+	return app.users.ClaimTOTPCounter(ctx, user.UserID, counter)
+}
+
+// newRecoveryCodes returns the codes to show once and the hashes to store.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 7)
+		if _, err = rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(encoding.EncodeToString(buf)[:10])
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, tokens.HashOneTimeToken(code))
+	}
+
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func (app *Application) bindAndValidate(c *gin.Context, request interface{}) bool {
+	if err := c.BindJSON(request); err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+		return false
+	}
+
+	if err := app.validate.Struct(request); err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+		return false
+	}
+
+	return true
+}
+
+func twoFactorError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errInvalidCode), errors.Is(err, database.ErrCodeAlreadyUsed),
+		errors.Is(err, database.ErrInvalidRecoveryCode):
+		c.JSON(http.StatusUnauthorized, errorBody(c, errInvalidCode.Error()))
+	case errors.Is(err, database.ErrTwoFactorNotPending):
+		c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+	default:
+		profileError(c, err)
+	}
+}
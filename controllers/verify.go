@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/mail"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/tokens"
+	"net/http"
+	"time"
+)
+
+func (app *Application) VerifyEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			c.JSON(http.StatusBadRequest, errorBody(c, "token is not set"))
+			c.Abort()
+			return
+		}
+
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		consumed, err := app.oneTimeTokens.ConsumeOneTimeToken(ctx,
+			models.PurposeEmailVerification, tokens.HashOneTimeToken(token))
+		if errors.Is(err, database.ErrInvalidOneTimeToken) {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+			return
+		}
+
+		err = app.users.MarkEmailVerified(ctx, consumed.UserID, consumed.Email)
+		if errors.Is(err, database.ErrEmailChanged) {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+		if err != nil {
+			profileError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, "Email verified")
+	}
+}
+
+func (app *Application) ResendVerification() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 30*time.Second)
+		defer cancel()
+
+		user, err := app.users.GetUser(ctx, c.GetString("uid"))
+		if err != nil {
+			profileError(c, err)
+			return
+		}
+
+		if err = app.sendVerification(ctx, &user); err != nil {
+			verificationError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, "Verification email sent")
+	}
+}
+
+// sendVerification emails a fresh verification link, which voids the links
+// sent before.
+func (app *Application) sendVerification(ctx context.Context, user *models.User) error {
+	err := app.users.ClaimVerificationSend(ctx, user.UserID, app.accountMail.ResendInterval)
+	if err != nil {
+		return err
+	}
+
+	token, hash, err := tokens.NewOneTimeToken()
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot issue verification token", "error", err)
+		return database.ErrCantIssueToken
+	}
+
+	err = app.oneTimeTokens.SaveOneTimeToken(ctx, user.UserID, user.Email, models.PurposeEmailVerification, hash, app.accountMail.VerifyTTL)
+	if err != nil {
+		return err
+	}
+
+	err = app.accountMail.Sender.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Confirm your email",
+		Body: fmt.Sprintf("Hello, %s!\n\nTo confirm your email address follow the link below. It is valid for %s.\n\n%s\n",
+			user.FirstName, app.accountMail.VerifyTTL, linkWithToken(app.accountMail.VerifyURL, token)),
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot send verification email", "error", err)
+		return mail.ErrCantSendMail
+	}
+
+	return nil
+}
+
+func verificationError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, database.ErrEmailAlreadyVerified):
+		c.JSON(http.StatusConflict, errorBody(c, err.Error()))
+	case errors.Is(err, database.ErrResendTooSoon):
+		c.JSON(http.StatusTooManyRequests, errorBody(c, err.Error()))
+	default:
+		profileError(c, err)
+	}
+}
@@ -0,0 +1,256 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrCantFindUser        = errors.New("cannot find the user")
+	ErrCantFindAddress     = errors.New("cannot find the address")
+	ErrAddressBookFull     = errors.New("address book is full")
+	ErrCantUpdateAddress   = errors.New("cannot update the address book")
+	ErrInvalidAddressUsage = errors.New("address usage must be shipping or billing")
+)
+
+func (users *MongoUsers) ListAddresses(ctx context.Context, userID string) ([]models.Address, error) {
+	ctx, span := startSpan(ctx, "database.MongoUsers.ListAddresses")
+	defer span.End()
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot list addresses", "error", err)
+		return nil, ErrUserIdIsNotValid
+	}
+
+	var user models.User
+	opts := options.FindOne().SetProjection(bson.M{"address": 1})
+	err = users.collection.FindOne(ctx, bson.M{"_id": id}, opts).Decode(&user)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot list addresses", "error", err)
+		return nil, ErrCantFindUser
+	}
+
+	if user.AddressDetails == nil {
+		return make([]models.Address, 0), nil
+	}
+
+	return user.AddressDetails, nil
+}
+
+func (users *MongoUsers) GetAddress(ctx context.Context,
+	userID string, addressID primitive.ObjectID) (models.Address, error) {
+	ctx, span := startSpan(ctx, "database.MongoUsers.GetAddress")
+	defer span.End()
+
+	addresses, err := users.ListAddresses(ctx, userID)
+	if err != nil {
+		return models.Address{}, err
+	}
+
+	for _, address := range addresses {
+		if address.AddressID == addressID {
+			return address, nil
+		}
+	}
+
+	return models.Address{}, ErrCantFindAddress
+}
+
+// AddAddress appends to the address book unless it already holds limit
+// entries. The first address becomes the default for shipping and billing,
+// later ones take over a default only when they ask for it.
+func (users *MongoUsers) AddAddress(ctx context.Context,
+	userID string, address *models.Address, limit int) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.AddAddress")
+	defer span.End()
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot add address", "error", err)
+		return ErrUserIdIsNotValid
+	}
+
+	addresses, err := users.ListAddresses(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if len(addresses) == 0 {
+		address.DefaultShipping = true
+		address.DefaultBilling = true
+	}
+
+	address.AddressID = primitive.NewObjectID()
+
+	filter := bson.M{
+		"_id":   id,
+		"$expr": bson.M{"$lt": bson.A{bson.M{"$size": bson.M{"$ifNull": bson.A{"$address", bson.A{}}}}, limit}},
+	}
+	update := bson.M{"$push": bson.M{"address": address}}
+	res, err := users.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot add address", "error", err)
+		return ErrCantUpdateAddress
+	}
+	if res.MatchedCount == 0 {
+		return ErrAddressBookFull
+	}
+
+	if len(addresses) == 0 {
+		return nil
+	}
+	if address.DefaultShipping {
+		if err = users.SetDefaultAddress(ctx, userID, address.AddressID, models.AddressShipping); err != nil {
+			return err
+		}
+	}
+	if address.DefaultBilling {
+		return users.SetDefaultAddress(ctx, userID, address.AddressID, models.AddressBilling)
+	}
+
+	return nil
+}
+
+// UpdateAddress replaces the fields of one entry; the default flags are only
+// changed through SetDefaultAddress.
+func (users *MongoUsers) UpdateAddress(ctx context.Context,
+	userID string, addressID primitive.ObjectID, address models.Address) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.UpdateAddress")
+	defer span.End()
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot update address", "error", err)
+		return ErrUserIdIsNotValid
+	}
+
+	filter := bson.M{"_id": id, "address._id": addressID}
+	update := bson.M{"$set": bson.M{
+		"address.$.label":       address.Label,
+		"address.$.house_name":  address.House,
+		"address.$.street_name": address.Street,
+		"address.$.city_name":   address.City,
+		"address.$.region":      address.Region,
+		"address.$.post_code":   address.PostCode,
+		"address.$.country":     address.Country,
+	}}
+	res, err := users.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot update address", "error", err)
+		return ErrCantUpdateAddress
+	}
+	if res.MatchedCount == 0 {
+		return ErrCantFindAddress
+	}
+
+	return nil
+}
+
+func (users *MongoUsers) DeleteAddress(ctx context.Context,
+	userID string, addressID primitive.ObjectID) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.DeleteAddress")
+	defer span.End()
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot delete address", "error", err)
+		return ErrUserIdIsNotValid
+	}
+
+	removed, err := users.GetAddress(ctx, userID, addressID)
+	if err != nil {
+		return err
+	}
+
+	update := bson.M{"$pull": bson.M{"address": bson.M{"_id": addressID}}}
+	_, err = users.collection.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot delete address", "error", err)
+		return ErrCantUpdateAddress
+	}
+
+	if !removed.DefaultShipping && !removed.DefaultBilling {
+		return nil
+	}
+
+	// Hand the default over to the oldest remaining entry.
+	remaining, err := users.ListAddresses(ctx, userID)
+	if err != nil || len(remaining) == 0 {
+		return err
+	}
+	if removed.DefaultShipping {
+		if err = users.SetDefaultAddress(ctx, userID, remaining[0].AddressID, models.AddressShipping); err != nil {
+			return err
+		}
+	}
+	if removed.DefaultBilling {
+		return users.SetDefaultAddress(ctx, userID, remaining[0].AddressID, models.AddressBilling)
+	}
+
+	return nil
+}
+
+func (users *MongoUsers) SetDefaultAddress(ctx context.Context,
+	userID string, addressID primitive.ObjectID, usage string) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.SetDefaultAddress")
+	defer span.End()
+
+	var field string
+	switch usage {
+	case models.AddressShipping:
+		field = "default_shipping"
+	case models.AddressBilling:
+		field = "default_billing"
+	default:
+		return ErrInvalidAddressUsage
+	}
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot set default address", "error", err)
+		return ErrUserIdIsNotValid
+	}
+
+	filter := bson.M{"_id": id, "address._id": addressID}
+	update := bson.M{"$set": bson.M{
+		"address.$[other]." + field:  false,
+		"address.$[target]." + field: true,
+	}}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{
+		bson.M{"other._id": bson.M{"$ne": addressID}},
+		bson.M{"target._id": addressID},
+	}})
+	res, err := users.collection.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot set default address", "error", err)
+		return ErrCantUpdateAddress
+	}
+	if res.MatchedCount == 0 {
+		return ErrCantFindAddress
+	}
+
+	return nil
+}
+
+// DefaultAddress picks the entry flagged for usage, falling back to the first
+// one for address books created before the flags existed.
+func DefaultAddress(user *models.User, usage string) *models.Address {
+	for i := range user.AddressDetails {
+		address := &user.AddressDetails[i]
+		if (usage == models.AddressShipping && address.DefaultShipping) ||
+			(usage == models.AddressBilling && address.DefaultBilling) {
+			return address
+		}
+	}
+
+	if len(user.AddressDetails) == 0 {
+		return nil
+	}
+
+	return &user.AddressDetails[0]
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+var (
+	ErrInvalidAPIKey    = errors.New("API key is invalid, revoked or expired")
+	ErrCantFindAPIKey   = errors.New("API key not found")
+	ErrCantCreateAPIKey = errors.New("cannot create the API key")
+)
+
+func APIKeyData(db *mongo.Database, collectionName string) *mongo.Collection {
+	var apiKeyCollection = db.Collection(collectionName)
+
+	return apiKeyCollection
+}
+
+func EnsureAPIKeyIndexes(ctx context.Context, apiKeyCollection *mongo.Collection) error {
+	ctx, span := startSpan(ctx, "database.EnsureAPIKeyIndexes")
+	defer span.End()
+
+	_, err := apiKeyCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "key_hash", Value: 1}}, Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot ensure API key indexes", "error", err)
+		return ErrCantCreateIndexes
+	}
+
+	return nil
+}
+
+// MongoAPIKeys keeps one document per API key.
+type MongoAPIKeys struct {
+	collection *mongo.Collection
+}
+
+func NewMongoAPIKeys(apiKeyCollection *mongo.Collection) *MongoAPIKeys {
+	return &MongoAPIKeys{collection: apiKeyCollection}
+}
+
+func (keys *MongoAPIKeys) CreateAPIKey(ctx context.Context, key *models.APIKey) error {
+	ctx, span := startSpan(ctx, "database.MongoAPIKeys.CreateAPIKey")
+	defer span.End()
+
+	if _, err := keys.collection.InsertOne(ctx, key); err != nil {
+		logging.FromContext(ctx).Error("cannot create API key", "error", err)
+		return ErrCantCreateAPIKey
+	}
+
+	return nil
+}
+
+func (keys *MongoAPIKeys) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	ctx, span := startSpan(ctx, "database.MongoAPIKeys.ListAPIKeys")
+	defer span.End()
+
+	cursor, err := keys.collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot list API keys", "error", err)
+		return nil, ErrCantFindAPIKey
+	}
+
+	list := make([]models.APIKey, 0)
+	if err = cursor.All(ctx, &list); err != nil {
+		logging.FromContext(ctx).Error("cannot list API keys", "error", err)
+		return nil, ErrCantFindAPIKey
+	}
+
+	return list, nil
+}
+
+func (keys *MongoAPIKeys) RevokeAPIKey(ctx context.Context, keyID primitive.ObjectID) error {
+	ctx, span := startSpan(ctx, "database.MongoAPIKeys.RevokeAPIKey")
+	defer span.End()
+
+	res, err := keys.collection.UpdateOne(ctx,
+		bson.M{"_id": keyID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot revoke API key", "error", err)
+		return ErrCantFindAPIKey
+	}
+	if res.MatchedCount == 0 {
+		return ErrCantFindAPIKey
+	}
+
+	return nil
+}
+
+// UseAPIKey finds the live key with the hash and records its use.
+func (keys *MongoAPIKeys) UseAPIKey(ctx context.Context, keyHash string) (models.APIKey, error) {
+	ctx, span := startSpan(ctx, "database.MongoAPIKeys.UseAPIKey")
+	defer span.End()
+
+	now := time.Now()
+	var key models.APIKey
+	err := keys.collection.FindOne(ctx, bson.M{
+		"key_hash":   keyHash,
+		"revoked_at": bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"expires_at": bson.M{"$exists": false}},
+			bson.M{"expires_at": bson.M{"$gt": now}},
+		},
+	}).Decode(&key)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.APIKey{}, ErrInvalidAPIKey
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot use API key", "error", err)
+		return models.APIKey{}, err
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= lastSeenPrecision {
+		_, err = keys.collection.UpdateOne(ctx, bson.M{"_id": key.KeyID}, bson.M{"$set": bson.M{"last_used_at": now}})
+		if err != nil {
+			logging.FromContext(ctx).Error("cannot use API key", "error", err)
+		}
+	}
+
+	return key, nil
+}
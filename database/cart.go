@@ -3,11 +3,12 @@ package database
 import (
 	"context"
 	"errors"
+	"github.com/koinav/ecommerce/logging"
 	"github.com/koinav/ecommerce/models"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"log"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"time"
 )
 
@@ -19,59 +20,65 @@ var (
 	ErrCantRemoveItemFromCart = errors.New("cannot remove this item from the cart")
 	ErrCantGetItem            = errors.New("unable to get the item from the cart")
 	ErrCantBuyCartItem        = errors.New("cannot update the purchase")
+	ErrCantCalculateTax       = errors.New("cannot calculate tax for the order")
+	ErrEmptyCart              = errors.New("cart is empty")
+	ErrCartChanged            = errors.New("cart has changed during checkout, review it and try again")
 )
 
-func AddProductToCart(ctx context.Context,
-	productCollection, userCollection *mongo.Collection,
-	productID primitive.ObjectID, userID string) error {
-	searchFromDB, err := productCollection.Find(ctx, bson.M{"_id": productID})
-	if err != nil {
-		log.Println(err)
-		return ErrCantFindProduct
-	}
+// MongoCarts keeps the cart embedded in the user document.
+type MongoCarts struct {
+	collection *mongo.Collection
+}
 
-	var productCart []models.ProductInCart
-	err = searchFromDB.All(ctx, &productCart)
-	if err != nil {
-		log.Println(err)
-		return ErrCantDecodeProducts
-	}
+func NewMongoCarts(userCollection *mongo.Collection) *MongoCarts {
+	return &MongoCarts{collection: userCollection}
+}
+
+func (carts *MongoCarts) AddItem(ctx context.Context, userID string, item models.ProductInCart) (bool, error) {
+	ctx, span := startSpan(ctx, "database.MongoCarts.AddItem")
+	defer span.End()
 
 	id, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
-		log.Println(err)
-		return ErrUserIdIsNotValid
+		logging.FromContext(ctx).Error("cannot add item", "error", err)
+		return false, ErrUserIdIsNotValid
 	}
 
 	filter := bson.D{primitive.E{Key: "_id", Value: id}}
-	update := bson.D{{
-		Key: "$push",
-		Value: bson.D{primitive.E{
-			Key:   "user_cart",
-			Value: bson.D{{Key: "$each", Value: productCart}},
-		}},
-	}}
-	_, err = userCollection.UpdateOne(ctx, filter, update)
+	update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "user_cart", Value: item}}}}
+	// The cart as it was before, cut to one item: enough to tell if it was empty.
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.Before).
+		SetProjection(bson.D{{Key: "_id", Value: 1}, {Key: "user_cart", Value: bson.M{"$slice": 1}}})
+
+	var before struct {
+		UserCart []bson.Raw `bson:"user_cart"`
+	}
+	err = carts.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, ErrCantFindUser
+	}
 	if err != nil {
-		log.Println(err)
-		return ErrCantUpdateUser
+		logging.FromContext(ctx).Error("cannot add item", "error", err)
+		return false, ErrCantUpdateUser
 	}
 
-	return nil
+	return len(before.UserCart) == 0, nil
 }
 
-func RemoveCartItem(ctx context.Context,
-	productCollection, userCollection *mongo.Collection,
-	productID primitive.ObjectID, userID string) error {
+func (carts *MongoCarts) RemoveItem(ctx context.Context, userID string, productID primitive.ObjectID) error {
+	ctx, span := startSpan(ctx, "database.MongoCarts.RemoveItem")
+	defer span.End()
+
 	id, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
-		log.Println(err)
+		logging.FromContext(ctx).Error("cannot remove item", "error", err)
 		return ErrUserIdIsNotValid
 	}
 
 	filter := bson.D{primitive.E{Key: "_id", Value: id}}
 	update := bson.M{"$pull": bson.M{"user_cart": bson.M{"_id": productID}}}
-	_, err = userCollection.UpdateMany(ctx, filter, update)
+	_, err = carts.collection.UpdateMany(ctx, filter, update)
 	if err != nil {
 		return ErrCantRemoveItemFromCart
 	}
@@ -79,119 +86,95 @@ func RemoveCartItem(ctx context.Context,
 	return nil
 }
 
-func BuyItemFromCart(ctx context.Context,
-	userCollection *mongo.Collection, userID string) error {
-	id, err := primitive.ObjectIDFromHex(userID)
+// AddProductToCart puts one unit of the product into the cart and reports
+// whether it started a new cart.
+func AddProductToCart(ctx context.Context,
+	products ProductRepository, carts CartRepository, productID primitive.ObjectID, userID string) (bool, error) {
+	ctx, span := startSpan(ctx, "database.AddProductToCart")
+	defer span.End()
+
+	product, err := products.GetProduct(ctx, productID)
 	if err != nil {
-		log.Println(err)
-		return ErrUserIdIsNotValid
+		return false, err
 	}
 
-	var getCartItems models.User
-	var orderCart models.Order
-
-	orderCart.OrderID = primitive.NewObjectID()
-	orderCart.OrderedAt = time.Now()
-	orderCart.OrderCart = make([]models.ProductInCart, 0)
-	orderCart.PaymentMethod.COD = true
+	return carts.AddItem(ctx, userID, CartItem(product))
+}
 
-	unwind := bson.D{{Key: "$unwind", Value: bson.D{primitive.E{Key: "path", Value: "$user_cart"}}}}
-	grouping := bson.D{{
-		Key: "$group",
-		Value: bson.D{primitive.E{Key: "_id", Value: "$_id"},
-			{Key: "total", Value: bson.D{primitive.E{Key: "$sum", Value: "$user_cart.price"}}}},
-	}}
+// BuyItemFromCart orders the cart of the user. It fails with ErrEmptyCart
+// before pricing, as an empty order would still be charged for shipping, and
+// with ErrCartChanged if the cart changes before the order is placed.
+func BuyItemFromCart(ctx context.Context,
+	users UserRepository, orders OrderRepository, pricing *Pricing, checkout Checkout, userID string) (models.Order, error) {
+	ctx, span := startSpan(ctx, "database.BuyItemFromCart")
+	defer span.End()
 
-	currentRes, err := userCollection.Aggregate(ctx, mongo.Pipeline{unwind, grouping})
+	buyer, err := users.GetUser(ctx, userID)
 	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	var getUserCart []bson.M
-	if err = currentRes.All(ctx, &getUserCart); err != nil {
-		log.Println(err)
-		return err
+		return models.Order{}, err
 	}
-
-	var totalPrice int32
-	for _, item := range getUserCart {
-		price := item["total"]
-		totalPrice = price.(int32)
+	if len(buyer.UserCart) == 0 {
+		return models.Order{}, ErrEmptyCart
 	}
-	orderCart.Price = int(totalPrice)
 
-	filter := bson.D{primitive.E{Key: "_id", Value: "id"}}
-	update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "orders", Value: orderCart}}}}
-	_, err = userCollection.UpdateMany(ctx, filter, update)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
+	var orderCart models.Order
+	orderCart.OrderID = primitive.NewObjectID()
+	orderCart.OrderedAt = time.Now()
+	orderCart.OrderCart = buyer.UserCart
+	orderCart.PaymentMethod.COD = true
 
-	err = userCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}).Decode(&getCartItems)
+	orderCart.ShippingAddress, orderCart.BillingAddress, err = checkout.resolveAddresses(&buyer)
 	if err != nil {
-		log.Println(err)
-		return err
+		return models.Order{}, err
 	}
 
-	filter1 := bson.D{primitive.E{Key: "_id", Value: id}}
-	update1 := bson.M{"&push": bson.M{"orders.$[].order_list": bson.M{"$each": getCartItems.UserCart}}}
-	_, err = userCollection.UpdateOne(ctx, filter1, update1)
+	err = pricing.PriceOrder(ctx, &orderCart, orderCart.ShippingAddress, checkout.Currency, checkout.ShippingMethod)
 	if err != nil {
-		log.Println(err)
-		return err
+		return models.Order{}, err
 	}
 
-	userCartEmpty := make([]models.ProductInCart, 0)
-	filter2 := bson.D{primitive.E{Key: "_id", Value: id}}
-	update2 := bson.D{{Key: "$set", Value: bson.D{primitive.E{Key: "user_cart", Value: userCartEmpty}}}}
-	_, err = userCollection.UpdateOne(ctx, filter2, update2)
-	if err != nil {
-		log.Println(err)
-		return err
+	if err = orders.PlaceOrder(ctx, userID, &orderCart, true); err != nil {
+		return models.Order{}, err
 	}
 
-	return nil
+	return orderCart, nil
 }
 
 func InstantBuy(ctx context.Context,
-	productCollection, userCollection *mongo.Collection,
-	productID primitive.ObjectID, userID string) error {
-	id, err := primitive.ObjectIDFromHex(userID)
+	products ProductRepository, users UserRepository, orders OrderRepository, pricing *Pricing,
+	checkout Checkout, productID primitive.ObjectID, userID string) (models.Order, error) {
+	ctx, span := startSpan(ctx, "database.InstantBuy")
+	defer span.End()
+
+	product, err := products.GetProduct(ctx, productID)
 	if err != nil {
-		log.Println(err)
-		return ErrUserIdIsNotValid
+		return models.Order{}, err
 	}
 
-	var productDetails models.ProductInCart
-	var orderDetails models.Order
+	buyer, err := users.GetUser(ctx, userID)
+	if err != nil {
+		return models.Order{}, err
+	}
 
+	var orderDetails models.Order
 	orderDetails.OrderID = primitive.NewObjectID()
 	orderDetails.OrderedAt = time.Now()
-	orderDetails.OrderCart = make([]models.ProductInCart, 0)
-
+	orderDetails.OrderCart = []models.ProductInCart{CartItem(product)}
 	orderDetails.PaymentMethod.COD = true
-	err = productCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: productID}}).Decode(&productDetails)
+
+	orderDetails.ShippingAddress, orderDetails.BillingAddress, err = checkout.resolveAddresses(&buyer)
 	if err != nil {
-		log.Println(err)
-		return ErrUserIdIsNotValid
+		return models.Order{}, err
 	}
-	orderDetails.Price = productDetails.Price
 
-	filter := bson.D{primitive.E{Key: "_id", Value: id}}
-	update := bson.D{{Key: "$push", Value: bson.D{primitive.E{Key: "orders", Value: orderDetails}}}}
-	_, err = userCollection.UpdateOne(ctx, filter, update)
+	err = pricing.PriceOrder(ctx, &orderDetails, orderDetails.ShippingAddress, checkout.Currency, checkout.ShippingMethod)
 	if err != nil {
-		log.Println(err)
+		return models.Order{}, err
 	}
 
-	filter1 := bson.D{primitive.E{Key: "_id", Value: id}}
-	update1 := bson.M{"&push": bson.M{"orders.$[].order_list": productDetails}}
-	_, err = userCollection.UpdateOne(ctx, filter1, update1)
-	if err != nil {
-		log.Println(err)
+	if err = orders.PlaceOrder(ctx, userID, &orderDetails, false); err != nil {
+		return models.Order{}, err
 	}
 
-	return nil
+	return orderDetails, nil
 }
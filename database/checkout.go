@@ -0,0 +1,74 @@
+package database
+
+import (
+	"errors"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrShippingAddressRequired = errors.New("shipping address is required to place an order")
+
+// Checkout carries what the buyer chose for an order. An address is taken
+// from the inline one-off value first, then from the address book by ID, and
+// finally falls back to the default entry of the address book.
+type Checkout struct {
+	Currency          string
+	ShippingMethod    string
+	ShippingAddressID primitive.ObjectID
+	BillingAddressID  primitive.ObjectID
+	ShippingAddress   *models.Address
+	BillingAddress    *models.Address
+}
+
+// resolveAddresses returns copies of the chosen addresses, detached from the
+// address book so that later edits there do not rewrite the order.
+func (checkout *Checkout) resolveAddresses(user *models.User) (shippingAddress, billingAddress *models.Address, err error) {
+	shippingAddress, err = pickAddress(user, checkout.ShippingAddress, checkout.ShippingAddressID, models.AddressShipping)
+	if err != nil {
+		return nil, nil, err
+	}
+	if shippingAddress == nil {
+		return nil, nil, ErrShippingAddressRequired
+	}
+
+	billingAddress, err = pickAddress(user, checkout.BillingAddress, checkout.BillingAddressID, models.AddressBilling)
+	if err != nil {
+		return nil, nil, err
+	}
+	if billingAddress == nil {
+		snapshot := *shippingAddress
+		billingAddress = &snapshot
+	}
+
+	return shippingAddress, billingAddress, nil
+}
+
+func pickAddress(user *models.User, inline *models.Address, addressID primitive.ObjectID, usage string) (*models.Address, error) {
+	var chosen *models.Address
+
+	switch {
+	case inline != nil:
+		chosen = inline
+	case !addressID.IsZero():
+		for i := range user.AddressDetails {
+			if user.AddressDetails[i].AddressID == addressID {
+				chosen = &user.AddressDetails[i]
+			}
+		}
+		if chosen == nil {
+			return nil, ErrCantFindAddress
+		}
+	default:
+		chosen = DefaultAddress(user, usage)
+	}
+
+	if chosen == nil {
+		return nil, nil
+	}
+
+	snapshot := *chosen
+	snapshot.DefaultShipping = false
+	snapshot.DefaultBilling = false
+
+	return &snapshot, nil
+}
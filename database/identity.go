@@ -0,0 +1,49 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrCantCreateUser = errors.New("user was not created")
+	ErrCantReadUser   = errors.New("cannot read the user")
+)
+
+// FindUserByIdentity returns the user linked to the subject of issuer.
+func (users *MongoUsers) FindUserByIdentity(ctx context.Context, issuer, subject string) (models.User, error) {
+	ctx, span := startSpan(ctx, "database.MongoUsers.FindUserByIdentity")
+	defer span.End()
+
+	var user models.User
+	err := users.collection.FindOne(ctx, bson.M{
+		"identities": bson.M{"$elemMatch": bson.M{"issuer": issuer, "subject": subject}},
+	}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.User{}, ErrCantFindUser
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot find user by identity", "error", err)
+		return models.User{}, ErrCantReadUser
+	}
+
+	return user, nil
+}
+
+func (users *MongoUsers) LinkIdentity(ctx context.Context, user *models.User, identity models.ExternalIdentity) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.LinkIdentity")
+	defer span.End()
+
+	_, err := users.collection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$push": bson.M{"identities": identity}})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot link identity", "error", err)
+		return ErrCantUpdateProfile
+	}
+
+	user.Identities = append(user.Identities, identity)
+	return nil
+}
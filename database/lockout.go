@@ -0,0 +1,57 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/ratelimit"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// RecordLoginFailure counts a failed login of the user and locks the account
+// once policy says so. locked is true only for the failure that locked an
+// unlocked account, so that the owner is notified once.
+func (users *MongoUsers) RecordLoginFailure(ctx context.Context,
+	user *models.User, policy ratelimit.Policy) (lockedUntil time.Time, locked bool, err error) {
+	ctx, span := startSpan(ctx, "database.MongoUsers.RecordLoginFailure")
+	defer span.End()
+
+	var updated models.User
+	err = users.collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": user.ID},
+		bson.M{"$inc": bson.M{"failed_logins": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, false, ErrCantFindUser
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot record login failure", "error", err)
+		return time.Time{}, false, ErrCantUpdateProfile
+	}
+
+	delay := policy.Delay(updated.FailedLogins)
+	if delay == 0 {
+		return time.Time{}, false, nil
+	}
+
+	lockedUntil = time.Now().Add(delay)
+	_, err = users.collection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"locked_until": lockedUntil}})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot record login failure", "error", err)
+		return time.Time{}, false, ErrCantUpdateProfile
+	}
+
+	return lockedUntil, updated.FailedLogins == policy.Threshold, nil
+}
+
+// UnlockAccount clears the failed login count and any lock.
+func (users *MongoUsers) UnlockAccount(ctx context.Context, userID string) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.UnlockAccount")
+	defer span.End()
+
+	return users.update(ctx, userID, bson.M{"failed_logins": 0, "locked_until": time.Time{}})
+}
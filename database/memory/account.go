@@ -0,0 +1,213 @@
+package memory
+
+import (
+	"context"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+	"time"
+)
+
+func (store *Store) CreateSession(_ context.Context, userID, userAgent, ip string, ttl time.Duration) (models.Session, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	session := models.Session{
+		SessionID:  primitive.NewObjectID(),
+		UserID:     userID,
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+	store.sessions[session.SessionID] = session
+
+	return session, nil
+}
+
+func (store *Store) ListSessions(_ context.Context, userID string) ([]models.Session, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	live := make([]models.Session, 0)
+	for _, session := range store.sessions {
+		if session.UserID == userID && sessionLive(&session, now) {
+			live = append(live, session)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].LastSeenAt.After(live[j].LastSeenAt) })
+
+	return live, nil
+}
+
+func (store *Store) TouchSession(_ context.Context, sessionID, userID, ip string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	id, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return database.ErrSessionRevoked
+	}
+
+	now := time.Now()
+	session, ok := store.sessions[id]
+	if !ok || session.UserID != userID || !sessionLive(&session, now) {
+		return database.ErrSessionRevoked
+	}
+
+	session.LastSeenAt = now
+	session.IP = ip
+	store.sessions[id] = session
+	return nil
+}
+
+func (store *Store) RevokeSession(_ context.Context, userID string, sessionID primitive.ObjectID) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	session, ok := store.sessions[sessionID]
+	if !ok || session.UserID != userID || session.RevokedAt != nil {
+		return database.ErrCantFindSession
+	}
+
+	now := time.Now()
+	session.RevokedAt = &now
+	store.sessions[sessionID] = session
+	return nil
+}
+
+func (store *Store) RevokeAllSessions(_ context.Context, userID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	for id, session := range store.sessions {
+		if session.UserID == userID && session.RevokedAt == nil {
+			session.RevokedAt = &now
+			store.sessions[id] = session
+		}
+	}
+
+	return nil
+}
+
+func sessionLive(session *models.Session, now time.Time) bool {
+	return session.RevokedAt == nil && session.ExpiresAt.After(now)
+}
+
+func (store *Store) SaveOneTimeToken(_ context.Context, userID, email, purpose, tokenHash string, ttl time.Duration) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	for i := range store.oneTimeTokens {
+		token := &store.oneTimeTokens[i]
+		if token.UserID == userID && token.Purpose == purpose && token.UsedAt == nil {
+			token.UsedAt = &now
+		}
+	}
+
+	store.oneTimeTokens = append(store.oneTimeTokens, models.OneTimeToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: tokenHash,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	return nil
+}
+
+func (store *Store) ConsumeOneTimeToken(_ context.Context, purpose, tokenHash string) (models.OneTimeToken, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	for i := range store.oneTimeTokens {
+		token := &store.oneTimeTokens[i]
+		if token.TokenHash == tokenHash && token.Purpose == purpose && token.UsedAt == nil && token.ExpiresAt.After(now) {
+			token.UsedAt = &now
+			return *token, nil
+		}
+	}
+
+	return models.OneTimeToken{}, database.ErrInvalidOneTimeToken
+}
+
+func (store *Store) CreateAPIKey(_ context.Context, key *models.APIKey) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, stored := range store.apiKeys {
+		if stored.KeyHash == key.KeyHash {
+			return database.ErrCantCreateAPIKey
+		}
+	}
+	if _, ok := store.apiKeys[key.KeyID]; ok {
+		return database.ErrCantCreateAPIKey
+	}
+
+	store.apiKeys[key.KeyID] = cloneAPIKey(key)
+	return nil
+}
+
+func (store *Store) ListAPIKeys(_ context.Context) ([]models.APIKey, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	list := make([]models.APIKey, 0, len(store.apiKeys))
+	for _, key := range store.apiKeys {
+		list = append(list, cloneAPIKey(&key))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+
+	return list, nil
+}
+
+func (store *Store) RevokeAPIKey(_ context.Context, keyID primitive.ObjectID) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key, ok := store.apiKeys[keyID]
+	if !ok || key.RevokedAt != nil {
+		return database.ErrCantFindAPIKey
+	}
+
+	now := time.Now()
+	key.RevokedAt = &now
+	store.apiKeys[keyID] = key
+	return nil
+}
+
+func (store *Store) UseAPIKey(_ context.Context, keyHash string) (models.APIKey, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	for id, key := range store.apiKeys {
+		if key.KeyHash != keyHash {
+			continue
+		}
+		if key.RevokedAt != nil || (key.ExpiresAt != nil && !key.ExpiresAt.After(now)) {
+			break
+		}
+
+		key.LastUsedAt = &now
+		store.apiKeys[id] = key
+		return cloneAPIKey(&key), nil
+	}
+
+	return models.APIKey{}, database.ErrInvalidAPIKey
+}
+
+func cloneAPIKey(key *models.APIKey) models.APIKey {
+	clone := *key
+	clone.Scopes = append([]string(nil), key.Scopes...)
+
+	return clone
+}
@@ -0,0 +1,139 @@
+package memory
+
+import (
+	"context"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (store *Store) ListAddresses(ctx context.Context, userID string) ([]models.Address, error) {
+	user, err := store.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return user.AddressDetails, nil
+}
+
+func (store *Store) GetAddress(ctx context.Context, userID string, addressID primitive.ObjectID) (models.Address, error) {
+	addresses, err := store.ListAddresses(ctx, userID)
+	if err != nil {
+		return models.Address{}, err
+	}
+
+	for _, address := range addresses {
+		if address.AddressID == addressID {
+			return address, nil
+		}
+	}
+
+	return models.Address{}, database.ErrCantFindAddress
+}
+
+func (store *Store) AddAddress(_ context.Context, userID string, address *models.Address, limit int) error {
+	return store.update(userID, func(user *models.User) error {
+		if len(user.AddressDetails) >= limit {
+			return database.ErrAddressBookFull
+		}
+
+		if len(user.AddressDetails) == 0 {
+			address.DefaultShipping = true
+			address.DefaultBilling = true
+		}
+		address.AddressID = primitive.NewObjectID()
+
+		user.AddressDetails = append(user.AddressDetails, *address)
+		if address.DefaultShipping {
+			setDefault(user, address.AddressID, models.AddressShipping)
+		}
+		if address.DefaultBilling {
+			setDefault(user, address.AddressID, models.AddressBilling)
+		}
+		return nil
+	})
+}
+
+func (store *Store) UpdateAddress(_ context.Context, userID string, addressID primitive.ObjectID, address models.Address) error {
+	return store.update(userID, func(user *models.User) error {
+		stored := findAddress(user, addressID)
+		if stored == nil {
+			return database.ErrCantFindAddress
+		}
+
+		stored.Label = address.Label
+		stored.House = address.House
+		stored.Street = address.Street
+		stored.City = address.City
+		stored.Region = address.Region
+		stored.PostCode = address.PostCode
+		stored.Country = address.Country
+		return nil
+	})
+}
+
+func (store *Store) DeleteAddress(_ context.Context, userID string, addressID primitive.ObjectID) error {
+	return store.update(userID, func(user *models.User) error {
+		removed := findAddress(user, addressID)
+		if removed == nil {
+			return database.ErrCantFindAddress
+		}
+
+		remaining := make([]models.Address, 0, len(user.AddressDetails))
+		for _, address := range user.AddressDetails {
+			if address.AddressID != addressID {
+				remaining = append(remaining, address)
+			}
+		}
+		wasShipping, wasBilling := removed.DefaultShipping, removed.DefaultBilling
+		user.AddressDetails = remaining
+
+		if len(remaining) == 0 {
+			return nil
+		}
+		if wasShipping {
+			setDefault(user, remaining[0].AddressID, models.AddressShipping)
+		}
+		if wasBilling {
+			setDefault(user, remaining[0].AddressID, models.AddressBilling)
+		}
+		return nil
+	})
+}
+
+func (store *Store) SetDefaultAddress(_ context.Context, userID string, addressID primitive.ObjectID, usage string) error {
+	if usage != models.AddressShipping && usage != models.AddressBilling {
+		return database.ErrInvalidAddressUsage
+	}
+
+	return store.update(userID, func(user *models.User) error {
+		if findAddress(user, addressID) == nil {
+			return database.ErrCantFindAddress
+		}
+
+		setDefault(user, addressID, usage)
+		return nil
+	})
+}
+
+func findAddress(user *models.User, addressID primitive.ObjectID) *models.Address {
+	for i := range user.AddressDetails {
+		if user.AddressDetails[i].AddressID == addressID {
+			return &user.AddressDetails[i]
+		}
+	}
+
+	return nil
+}
+
+func setDefault(user *models.User, addressID primitive.ObjectID, usage string) {
+	for i := range user.AddressDetails {
+		address := &user.AddressDetails[i]
+		isTarget := address.AddressID == addressID
+		if usage == models.AddressShipping {
+			address.DefaultShipping = isTarget
+		} else {
+			address.DefaultBilling = isTarget
+		}
+	}
+}
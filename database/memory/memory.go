@@ -0,0 +1,385 @@
+// Package memory keeps users, products, carts, orders, sessions, emailed
+// tokens, API keys and shipments in process memory. It implements the
+// repositories of package database with the same errors as the MongoDB
+// ones, so handlers can be tested without a database.
+package memory
+
+import (
+	"context"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/ratelimit"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sync"
+	"time"
+)
+
+// Store is safe for concurrent use. Values are copied in and out, so callers
+// never share memory with the store.
+type Store struct {
+	mu       sync.Mutex
+	users    map[primitive.ObjectID]*models.User
+	products map[primitive.ObjectID]models.Product
+	// productOrder keeps ListProducts in insertion order, like a collection scan.
+	productOrder []primitive.ObjectID
+
+	sessions      map[primitive.ObjectID]models.Session
+	oneTimeTokens []models.OneTimeToken
+	apiKeys       map[primitive.ObjectID]models.APIKey
+	shipments     map[primitive.ObjectID]models.Shipment
+	// shipmentOrder keeps OrderShipments in insertion order.
+	shipmentOrder []primitive.ObjectID
+}
+
+var (
+	_ database.UserRepository    = (*Store)(nil)
+	_ database.ProductRepository = (*Store)(nil)
+	_ database.CartRepository    = (*Store)(nil)
+	_ database.OrderRepository   = (*Store)(nil)
+
+	_ database.SessionRepository      = (*Store)(nil)
+	_ database.OneTimeTokenRepository = (*Store)(nil)
+	_ database.APIKeyRepository       = (*Store)(nil)
+	_ database.ShipmentRepository     = (*Store)(nil)
+)
+
+func NewStore() *Store {
+	return &Store{
+		users:     make(map[primitive.ObjectID]*models.User),
+		products:  make(map[primitive.ObjectID]models.Product),
+		sessions:  make(map[primitive.ObjectID]models.Session),
+		apiKeys:   make(map[primitive.ObjectID]models.APIKey),
+		shipments: make(map[primitive.ObjectID]models.Shipment),
+	}
+}
+
+func (store *Store) CreateUser(_ context.Context, user *models.User) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if user.Email != "" && store.taken(user.ID, "email", user.Email) {
+		return database.ErrEmailTaken
+	}
+	if user.Phone != "" && store.taken(user.ID, "phone", user.Phone) {
+		return database.ErrPhoneTaken
+	}
+	for _, identity := range user.Identities {
+		if _, ok := store.byIdentity(identity.Issuer, identity.Subject); ok {
+			return database.ErrIdentityTaken
+		}
+	}
+	if _, ok := store.users[user.ID]; ok {
+		return database.ErrCantCreateUser
+	}
+
+	stored := cloneUser(user)
+	store.users[user.ID] = &stored
+	return nil
+}
+
+func (store *Store) GetUser(_ context.Context, userID string) (models.User, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	user, err := store.user(userID)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	return cloneUser(user), nil
+}
+
+func (store *Store) FindUserByEmail(_ context.Context, email string) (models.User, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, user := range store.users {
+		if user.Email == email {
+			return cloneUser(user), nil
+		}
+	}
+
+	return models.User{}, database.ErrCantFindUser
+}
+
+func (store *Store) FindUserByIdentity(_ context.Context, issuer, subject string) (models.User, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	user, ok := store.byIdentity(issuer, subject)
+	if !ok {
+		return models.User{}, database.ErrCantFindUser
+	}
+
+	return cloneUser(user), nil
+}
+
+func (store *Store) LinkIdentity(_ context.Context, user *models.User, identity models.ExternalIdentity) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored, ok := store.users[user.ID]
+	if !ok {
+		return database.ErrCantUpdateProfile
+	}
+	if _, ok = store.byIdentity(identity.Issuer, identity.Subject); ok {
+		return database.ErrCantUpdateProfile
+	}
+
+	stored.Identities = append(stored.Identities, identity)
+	user.Identities = append(user.Identities, identity)
+	return nil
+}
+
+func (store *Store) UpdateName(_ context.Context, userID, firstName, lastName string) error {
+	return store.update(userID, func(user *models.User) error {
+		user.FirstName = firstName
+		user.LastName = lastName
+		return nil
+	})
+}
+
+func (store *Store) ChangeEmail(_ context.Context, userID, email string) error {
+	return store.update(userID, func(user *models.User) error {
+		if store.taken(user.ID, "email", email) {
+			return database.ErrEmailTaken
+		}
+		user.Email = email
+		user.EmailVerified = false
+		user.VerificationSentAt = time.Time{}
+		return nil
+	})
+}
+
+func (store *Store) ChangePhone(_ context.Context, userID, phone string) error {
+	return store.update(userID, func(user *models.User) error {
+		if store.taken(user.ID, "phone", phone) {
+			return database.ErrPhoneTaken
+		}
+		user.Phone = phone
+		return nil
+	})
+}
+
+func (store *Store) ChangePassword(_ context.Context, userID, hashedPassword string) error {
+	return store.update(userID, func(user *models.User) error {
+		user.Password = hashedPassword
+		return nil
+	})
+}
+
+func (store *Store) ResetPassword(_ context.Context, userID, hashedPassword string) error {
+	return store.update(userID, func(user *models.User) error {
+		user.Password = hashedPassword
+		user.Token = ""
+		user.RefreshToken = ""
+		user.TokensRevokedAt = time.Now()
+		return nil
+	})
+}
+
+func (store *Store) UpdateTokens(_ context.Context, userID, token, refreshToken string) error {
+	return store.update(userID, func(user *models.User) error {
+		user.Token = token
+		user.RefreshToken = refreshToken
+		return nil
+	})
+}
+
+func (store *Store) MarkEmailVerified(_ context.Context, userID, email string) error {
+	return store.update(userID, func(user *models.User) error {
+		if user.Email != email {
+			return database.ErrEmailChanged
+		}
+		user.EmailVerified = true
+		return nil
+	})
+}
+
+func (store *Store) ClaimVerificationSend(_ context.Context, userID string, interval time.Duration) error {
+	return store.update(userID, func(user *models.User) error {
+		now := time.Now()
+		if user.EmailVerified {
+			return database.ErrEmailAlreadyVerified
+		}
+		if !user.VerificationSentAt.IsZero() && user.VerificationSentAt.After(now.Add(-interval)) {
+			return database.ErrResendTooSoon
+		}
+		user.VerificationSentAt = now
+		return nil
+	})
+}
+
+func (store *Store) SetPendingTOTPSecret(_ context.Context, userID, secret string) error {
+	return store.update(userID, func(user *models.User) error {
+		user.PendingTOTPSecret = secret
+		return nil
+	})
+}
+
+func (store *Store) EnableTwoFactor(_ context.Context, userID, secret string, counter int64, recoveryHashes []string) error {
+	return store.update(userID, func(user *models.User) error {
+		if user.PendingTOTPSecret != secret {
+			return database.ErrTwoFactorNotPending
+		}
+		user.TwoFactorEnabled = true
+		user.TOTPSecret = secret
+		user.PendingTOTPSecret = ""
+		user.TOTPLastCounter = counter
+		user.RecoveryCodes = append([]string(nil), recoveryHashes...)
+		return nil
+	})
+}
+
+func (store *Store) DisableTwoFactor(_ context.Context, userID string) error {
+	return store.update(userID, func(user *models.User) error {
+		user.TwoFactorEnabled = false
+		user.TOTPSecret = ""
+		user.PendingTOTPSecret = ""
+		user.TOTPLastCounter = 0
+		user.RecoveryCodes = []string{}
+		return nil
+	})
+}
+
+func (store *Store) ClaimTOTPCounter(_ context.Context, userID string, counter int64) error {
+	return store.update(userID, func(user *models.User) error {
+		if user.TOTPLastCounter >= counter {
+			return database.ErrCodeAlreadyUsed
+		}
+		user.TOTPLastCounter = counter
+		return nil
+	})
+}
+
+func (store *Store) UseRecoveryCode(_ context.Context, userID, codeHash string) error {
+	return store.update(userID, func(user *models.User) error {
+		for i, stored := range user.RecoveryCodes {
+			if stored == codeHash {
+				user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		return database.ErrInvalidRecoveryCode
+	})
+}
+
+func (store *Store) RecordLoginFailure(_ context.Context,
+	user *models.User, policy ratelimit.Policy) (lockedUntil time.Time, locked bool, err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored, ok := store.users[user.ID]
+	if !ok {
+		return time.Time{}, false, database.ErrCantFindUser
+	}
+
+	stored.FailedLogins++
+	delay := policy.Delay(stored.FailedLogins)
+	if delay == 0 {
+		return time.Time{}, false, nil
+	}
+
+	stored.LockedUntil = time.Now().Add(delay)
+	return stored.LockedUntil, stored.FailedLogins == policy.Threshold, nil
+}
+
+func (store *Store) UnlockAccount(_ context.Context, userID string) error {
+	return store.update(userID, func(user *models.User) error {
+		user.FailedLogins = 0
+		user.LockedUntil = time.Time{}
+		return nil
+	})
+}
+
+// user returns the stored user; the caller must hold the lock.
+func (store *Store) user(userID string) (*models.User, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, database.ErrUserIdIsNotValid
+	}
+
+	user, ok := store.users[id]
+	if !ok {
+		return nil, database.ErrCantFindUser
+	}
+
+	return user, nil
+}
+
+// update applies change to the user under the lock. Like the MongoDB
+// implementation it does nothing unless change succeeds.
+func (store *Store) update(userID string, change func(user *models.User) error) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	user, err := store.user(userID)
+	if err != nil {
+		return err
+	}
+
+	updated := cloneUser(user)
+	if err = change(&updated); err != nil {
+		return err
+	}
+
+	updated.UpdatedAt = time.Now()
+	*user = updated
+	return nil
+}
+
+func (store *Store) taken(id primitive.ObjectID, field, value string) bool {
+	for _, user := range store.users {
+		if user.ID == id {
+			continue
+		}
+		if (field == "email" && user.Email == value) || (field == "phone" && user.Phone == value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (store *Store) byIdentity(issuer, subject string) (*models.User, bool) {
+	for _, user := range store.users {
+		for _, identity := range user.Identities {
+			if identity.Issuer == issuer && identity.Subject == subject {
+				return user, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// cloneUser copies the user deep enough that no slice is shared.
+func cloneUser(user *models.User) models.User {
+	clone := *user
+	clone.RecoveryCodes = append([]string(nil), user.RecoveryCodes...)
+	clone.Identities = append([]models.ExternalIdentity(nil), user.Identities...)
+	clone.UserCart = append(make([]models.ProductInCart, 0, len(user.UserCart)), user.UserCart...)
+	clone.AddressDetails = append(make([]models.Address, 0, len(user.AddressDetails)), user.AddressDetails...)
+	clone.OrderStatus = make([]models.Order, len(user.OrderStatus))
+	for i := range user.OrderStatus {
+		clone.OrderStatus[i] = cloneOrder(&user.OrderStatus[i])
+	}
+
+	return clone
+}
+
+func cloneOrder(order *models.Order) models.Order {
+	clone := *order
+	clone.OrderCart = append([]models.ProductInCart(nil), order.OrderCart...)
+	clone.TaxLines = append([]models.TaxLine(nil), order.TaxLines...)
+	if order.ShippingAddress != nil {
+		address := *order.ShippingAddress
+		clone.ShippingAddress = &address
+	}
+	if order.BillingAddress != nil {
+		address := *order.BillingAddress
+		clone.BillingAddress = &address
+	}
+
+	return clone
+}
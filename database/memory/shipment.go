@@ -0,0 +1,78 @@
+package memory
+
+import (
+	"context"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// AddShipment checks and records the shipment under one lock, so concurrent
+// shipments never exceed the order.
+func (store *Store) AddShipment(_ context.Context, shipment *models.Shipment, ordered map[primitive.ObjectID]int) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := database.CheckShipmentFits(ordered, store.orderShipments(shipment.OrderID), shipment); err != nil {
+		return err
+	}
+	if _, ok := store.shipments[shipment.ShipmentID]; ok {
+		return database.ErrCantCreateShipment
+	}
+
+	store.shipments[shipment.ShipmentID] = cloneShipment(shipment)
+	store.shipmentOrder = append(store.shipmentOrder, shipment.ShipmentID)
+	return nil
+}
+
+func (store *Store) AddTrackingEvent(_ context.Context, shipmentID primitive.ObjectID, event models.TrackingEvent) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	shipment, ok := store.shipments[shipmentID]
+	if !ok {
+		return database.ErrCantFindShipment
+	}
+	if shipment.Status == models.ShipmentDelivered {
+		return database.ErrShipmentAlreadyClosed
+	}
+
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now()
+	}
+	shipment = cloneShipment(&shipment)
+	shipment.Events = append(shipment.Events, event)
+	shipment.Status = event.Status
+	shipment.UpdatedAt = time.Now()
+	store.shipments[shipmentID] = shipment
+	return nil
+}
+
+func (store *Store) OrderShipments(_ context.Context, orderID primitive.ObjectID) ([]models.Shipment, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.orderShipments(orderID), nil
+}
+
+// orderShipments copies the shipments of the order; the caller must hold
+// the lock.
+func (store *Store) orderShipments(orderID primitive.ObjectID) []models.Shipment {
+	found := make([]models.Shipment, 0)
+	for _, id := range store.shipmentOrder {
+		if shipment := store.shipments[id]; shipment.OrderID == orderID {
+			found = append(found, cloneShipment(&shipment))
+		}
+	}
+
+	return found
+}
+
+func cloneShipment(shipment *models.Shipment) models.Shipment {
+	clone := *shipment
+	clone.Items = append([]models.ShipmentItem(nil), shipment.Items...)
+	clone.Events = append([]models.TrackingEvent(nil), shipment.Events...)
+
+	return clone
+}
@@ -0,0 +1,117 @@
+package memory
+
+import (
+	"context"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (store *Store) AddProduct(_ context.Context, product *models.Product) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.products[product.ProductID]; ok {
+		return database.ErrCantAddProduct
+	}
+
+	store.products[product.ProductID] = *product
+	store.productOrder = append(store.productOrder, product.ProductID)
+	return nil
+}
+
+func (store *Store) GetProduct(_ context.Context, productID primitive.ObjectID) (models.Product, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	product, ok := store.products[productID]
+	if !ok {
+		return models.Product{}, database.ErrCantFindProduct
+	}
+
+	return product, nil
+}
+
+func (store *Store) ListProducts(_ context.Context) ([]models.Product, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	productList := make([]models.Product, 0, len(store.productOrder))
+	for _, id := range store.productOrder {
+		productList = append(productList, store.products[id])
+	}
+
+	return productList, nil
+}
+
+func (store *Store) AddItem(_ context.Context, userID string, item models.ProductInCart) (bool, error) {
+	var created bool
+	err := store.update(userID, func(user *models.User) error {
+		created = len(user.UserCart) == 0
+		user.UserCart = append(user.UserCart, item)
+		return nil
+	})
+
+	return created, err
+}
+
+func (store *Store) RemoveItem(_ context.Context, userID string, productID primitive.ObjectID) error {
+	return store.update(userID, func(user *models.User) error {
+		remaining := make([]models.ProductInCart, 0, len(user.UserCart))
+		for _, item := range user.UserCart {
+			if item.ProductID != productID {
+				remaining = append(remaining, item)
+			}
+		}
+		user.UserCart = remaining
+		return nil
+	})
+}
+
+func (store *Store) PlaceOrder(_ context.Context, userID string, order *models.Order, emptyCart bool) error {
+	return store.update(userID, func(user *models.User) error {
+		if emptyCart {
+			if len(user.UserCart) != len(order.OrderCart) {
+				return database.ErrCartChanged
+			}
+			for i, item := range order.OrderCart {
+				if user.UserCart[i].ProductID != item.ProductID {
+					return database.ErrCartChanged
+				}
+			}
+			user.UserCart = make([]models.ProductInCart, 0)
+		}
+		user.OrderStatus = append(user.OrderStatus, cloneOrder(order))
+		return nil
+	})
+}
+
+func (store *Store) GetOrder(ctx context.Context, userID string, orderID primitive.ObjectID) (models.Order, error) {
+	user, err := store.GetUser(ctx, userID)
+	if err != nil {
+		return models.Order{}, err
+	}
+
+	for _, order := range user.OrderStatus {
+		if order.OrderID == orderID {
+			return order, nil
+		}
+	}
+
+	return models.Order{}, database.ErrCantFindOrder
+}
+
+func (store *Store) FindOrder(_ context.Context, orderID primitive.ObjectID) (string, models.Order, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, user := range store.users {
+		for i := range user.OrderStatus {
+			if user.OrderStatus[i].OrderID == orderID {
+				return user.UserID, cloneOrder(&user.OrderStatus[i]), nil
+			}
+		}
+	}
+
+	return "", models.Order{}, database.ErrCantFindOrder
+}
@@ -0,0 +1,113 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+var (
+	ErrInvalidOneTimeToken = errors.New("token is invalid or expired")
+	ErrCantIssueToken      = errors.New("cannot issue the token")
+)
+
+func OneTimeTokenData(db *mongo.Database, collectionName string) *mongo.Collection {
+	var tokenCollection = db.Collection(collectionName)
+
+	return tokenCollection
+}
+
+// EnsureOneTimeTokenIndexes lets MongoDB drop expired tokens by itself.
+func EnsureOneTimeTokenIndexes(ctx context.Context, tokenCollection *mongo.Collection) error {
+	ctx, span := startSpan(ctx, "database.EnsureOneTimeTokenIndexes")
+	defer span.End()
+
+	_, err := tokenCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot ensure one time token indexes", "error", err)
+		return ErrCantCreateIndexes
+	}
+
+	return nil
+}
+
+// MongoOneTimeTokens keeps the hashes of the emailed tokens; MongoDB drops
+// them once expired.
+type MongoOneTimeTokens struct {
+	collection *mongo.Collection
+}
+
+func NewMongoOneTimeTokens(tokenCollection *mongo.Collection) *MongoOneTimeTokens {
+	return &MongoOneTimeTokens{collection: tokenCollection}
+}
+
+// SaveOneTimeToken stores the hash of a fresh token for purpose along with the
+// email it goes to, and voids the earlier unused ones, so only the latest
+// emailed link works.
+func (tokens *MongoOneTimeTokens) SaveOneTimeToken(ctx context.Context,
+	userID, email, purpose, tokenHash string, ttl time.Duration) error {
+	ctx, span := startSpan(ctx, "database.MongoOneTimeTokens.SaveOneTimeToken")
+	defer span.End()
+
+	now := time.Now()
+	_, err := tokens.collection.UpdateMany(ctx,
+		bson.M{"user_id": userID, "purpose": purpose, "used_at": nil},
+		bson.M{"$set": bson.M{"used_at": now}})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot save one time token", "error", err)
+		return ErrCantIssueToken
+	}
+
+	_, err = tokens.collection.InsertOne(ctx, models.OneTimeToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: tokenHash,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot save one time token", "error", err)
+		return ErrCantIssueToken
+	}
+
+	return nil
+}
+
+// ConsumeOneTimeToken marks the token used and returns it; a token can be
+// consumed only once.
+func (tokens *MongoOneTimeTokens) ConsumeOneTimeToken(ctx context.Context,
+	purpose, tokenHash string) (models.OneTimeToken, error) {
+	ctx, span := startSpan(ctx, "database.MongoOneTimeTokens.ConsumeOneTimeToken")
+	defer span.End()
+
+	now := time.Now()
+	filter := bson.M{
+		"token_hash": tokenHash,
+		"purpose":    purpose,
+		"used_at":    nil,
+		"expires_at": bson.M{"$gt": now},
+	}
+
+	var consumed models.OneTimeToken
+	err := tokens.collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"used_at": now}}).Decode(&consumed)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.OneTimeToken{}, ErrInvalidOneTimeToken
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot consume one time token", "error", err)
+		return models.OneTimeToken{}, ErrInvalidOneTimeToken
+	}
+
+	return consumed, nil
+}
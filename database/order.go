@@ -0,0 +1,113 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MongoOrders keeps the orders embedded in the user document.
+type MongoOrders struct {
+	collection *mongo.Collection
+}
+
+func NewMongoOrders(userCollection *mongo.Collection) *MongoOrders {
+	return &MongoOrders{collection: userCollection}
+}
+
+// PlaceOrder appends the order and empties the cart in one update, so an
+// order is never recorded with the cart left behind. The update only applies
+// while the cart still holds the lines of the order, one by one; anything
+// added during checkout fails it with ErrCartChanged instead of being lost.
+func (orders *MongoOrders) PlaceOrder(ctx context.Context, userID string, order *models.Order, emptyCart bool) error {
+	ctx, span := startSpan(ctx, "database.MongoOrders.PlaceOrder")
+	defer span.End()
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot place order", "error", err)
+		return ErrUserIdIsNotValid
+	}
+
+	filter := bson.M{"_id": id}
+	update := bson.M{"$push": bson.M{"orders": order}}
+	if emptyCart {
+		filter["user_cart"] = bson.M{"$size": len(order.OrderCart)}
+		for i, item := range order.OrderCart {
+			filter[fmt.Sprintf("user_cart.%d._id", i)] = item.ProductID
+		}
+		update["$set"] = bson.M{"user_cart": make([]models.ProductInCart, 0)}
+	}
+
+	res, err := orders.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot place order", "error", err)
+		return ErrCantBuyCartItem
+	}
+	if res.MatchedCount == 0 && emptyCart {
+		return ErrCartChanged
+	}
+	if res.MatchedCount == 0 {
+		return ErrCantFindUser
+	}
+
+	return nil
+}
+
+func (orders *MongoOrders) GetOrder(ctx context.Context, userID string, orderID primitive.ObjectID) (models.Order, error) {
+	ctx, span := startSpan(ctx, "database.MongoOrders.GetOrder")
+	defer span.End()
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot get order", "error", err)
+		return models.Order{}, ErrUserIdIsNotValid
+	}
+
+	var owner models.User
+	err = orders.collection.FindOne(ctx, bson.M{"_id": id, "orders._id": orderID}).Decode(&owner)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot get order", "error", err)
+		return models.Order{}, ErrCantFindOrder
+	}
+
+	order, ok := findOrder(&owner, orderID)
+	if !ok {
+		return models.Order{}, ErrCantFindOrder
+	}
+
+	return *order, nil
+}
+
+func (orders *MongoOrders) FindOrder(ctx context.Context, orderID primitive.ObjectID) (string, models.Order, error) {
+	ctx, span := startSpan(ctx, "database.MongoOrders.FindOrder")
+	defer span.End()
+
+	var owner models.User
+	err := orders.collection.FindOne(ctx, bson.M{"orders._id": orderID}).Decode(&owner)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot find order", "error", err)
+		return "", models.Order{}, ErrCantFindOrder
+	}
+
+	order, ok := findOrder(&owner, orderID)
+	if !ok {
+		return "", models.Order{}, ErrCantFindOrder
+	}
+
+	return owner.UserID, *order, nil
+}
+
+func findOrder(user *models.User, orderID primitive.ObjectID) (*models.Order, bool) {
+	for i := range user.OrderStatus {
+		if user.OrderStatus[i].OrderID == orderID {
+			return &user.OrderStatus[i], true
+		}
+	}
+
+	return nil, false
+}
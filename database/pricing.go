@@ -0,0 +1,99 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/money"
+	"github.com/koinav/ecommerce/shipping"
+	"github.com/koinav/ecommerce/tax"
+)
+
+var ErrCantConvertPrice = errors.New("cannot convert the price to the requested currency")
+
+// Pricing converts, taxes and ships amounts. Legacy reads the prices sent as
+// bare numbers in major units of the shop currency.
+type Pricing struct {
+	TaxCalculator tax.TaxCalculator
+	ShippingRates *shipping.Rates
+	Exchange      *money.ExchangeRates
+	Legacy        money.Legacy
+}
+
+// ConvertItems returns a copy of items priced in currency.
+func (pricing *Pricing) ConvertItems(ctx context.Context, items []models.ProductInCart, currency string) ([]models.ProductInCart, error) {
+	converted := make([]models.ProductInCart, len(items))
+	for i, item := range items {
+		price, err := pricing.Exchange.Convert(item.Price, currency)
+		if err != nil {
+			logging.FromContext(ctx).Error("cannot convert items", "error", err)
+			return nil, ErrCantConvertPrice
+		}
+		item.Price = price
+		converted[i] = item
+	}
+
+	return converted, nil
+}
+
+func (pricing *Pricing) ConvertProducts(ctx context.Context, products []models.Product, currency string) ([]models.Product, error) {
+	converted := make([]models.Product, len(products))
+	for i, product := range products {
+		price, err := pricing.Exchange.Convert(product.Price, currency)
+		if err != nil {
+			logging.FromContext(ctx).Error("cannot convert products", "error", err)
+			return nil, ErrCantConvertPrice
+		}
+		product.Price = price
+		converted[i] = product
+	}
+
+	return converted, nil
+}
+
+func (pricing *Pricing) CartTotals(ctx context.Context, items []models.ProductInCart, address *models.Address, currency string) ([]models.ProductInCart, tax.Result, error) {
+	converted, err := pricing.ConvertItems(ctx, items, currency)
+	if err != nil {
+		return nil, tax.Result{}, err
+	}
+
+	result, err := pricing.TaxCalculator.Calculate(tax.DestinationFromAddress(address), currency, converted)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot calculate tax", "error", err)
+		return nil, tax.Result{}, ErrCantCalculateTax
+	}
+
+	return converted, result, nil
+}
+
+// PriceOrder converts the order lines into currency and fills in tax,
+// shipping and the total to pay.
+func (pricing *Pricing) PriceOrder(ctx context.Context, order *models.Order, address *models.Address, currency, shippingMethod string) error {
+	items, totals, err := pricing.CartTotals(ctx, order.OrderCart, address, currency)
+	if err != nil {
+		return err
+	}
+
+	quote, err := pricing.ShippingRates.Select(items, address, currency, shippingMethod)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot price order", "error", err)
+		return err
+	}
+
+	order.OrderCart = items
+	order.Tax = totals.Tax
+	order.TaxIncluded = totals.Included
+	order.TaxLines = totals.Lines
+	order.ShippingMethod = quote.Code
+	order.ShippingCost = quote.Price
+	order.Discount = money.Zero(currency)
+
+	order.Price, err = totals.Total.Add(quote.Price)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot price order", "error", err)
+		return ErrCantConvertPrice
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrCantAddProduct = errors.New("cannot add the product")
+
+type MongoProducts struct {
+	collection *mongo.Collection
+}
+
+func NewMongoProducts(productCollection *mongo.Collection) *MongoProducts {
+	return &MongoProducts{collection: productCollection}
+}
+
+func (products *MongoProducts) AddProduct(ctx context.Context, product *models.Product) error {
+	ctx, span := startSpan(ctx, "database.MongoProducts.AddProduct")
+	defer span.End()
+
+	_, err := products.collection.InsertOne(ctx, product)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot add product", "error", err)
+		return ErrCantAddProduct
+	}
+
+	return nil
+}
+
+func (products *MongoProducts) GetProduct(ctx context.Context, productID primitive.ObjectID) (models.Product, error) {
+	ctx, span := startSpan(ctx, "database.MongoProducts.GetProduct")
+	defer span.End()
+
+	var product models.Product
+	err := products.collection.FindOne(ctx, bson.M{"_id": productID}).Decode(&product)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot get product", "error", err)
+		return models.Product{}, ErrCantFindProduct
+	}
+
+	return product, nil
+}
+
+func (products *MongoProducts) ListProducts(ctx context.Context) ([]models.Product, error) {
+	ctx, span := startSpan(ctx, "database.MongoProducts.ListProducts")
+	defer span.End()
+
+	cursor, err := products.collection.Find(ctx, bson.D{})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot list products", "error", err)
+		return nil, ErrCantDecodeProducts
+	}
+
+	productList := make([]models.Product, 0)
+	if err = cursor.All(ctx, &productList); err != nil {
+		logging.FromContext(ctx).Error("cannot list products", "error", err)
+		return nil, ErrCantDecodeProducts
+	}
+
+	return productList, nil
+}
@@ -0,0 +1,140 @@
+package database
+
+import (
+	"context"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/ratelimit"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// UserRepository stores user accounts together with their address books.
+// Implementations report the errors of this package, e.g. ErrCantFindUser,
+// so that handlers do not depend on the storage behind them.
+type UserRepository interface {
+	// CreateUser fails with ErrEmailTaken, ErrPhoneTaken or ErrIdentityTaken
+	// for duplicates.
+	CreateUser(ctx context.Context, user *models.User) error
+	GetUser(ctx context.Context, userID string) (models.User, error)
+	// FindUserByEmail fails with ErrCantFindUser only if no user has the
+	// email.
+	FindUserByEmail(ctx context.Context, email string) (models.User, error)
+	// FindUserByIdentity fails with ErrCantFindUser only if no user is
+	// linked to the subject.
+	FindUserByIdentity(ctx context.Context, issuer, subject string) (models.User, error)
+	LinkIdentity(ctx context.Context, user *models.User, identity models.ExternalIdentity) error
+
+	UpdateName(ctx context.Context, userID, firstName, lastName string) error
+	ChangeEmail(ctx context.Context, userID, email string) error
+	ChangePhone(ctx context.Context, userID, phone string) error
+	ChangePassword(ctx context.Context, userID, hashedPassword string) error
+	// ResetPassword sets a new password and revokes every token issued before.
+	ResetPassword(ctx context.Context, userID, hashedPassword string) error
+	UpdateTokens(ctx context.Context, userID, token, refreshToken string) error
+	// MarkEmailVerified fails with ErrEmailChanged unless email is still
+	// the address of the user.
+	MarkEmailVerified(ctx context.Context, userID, email string) error
+	// ClaimVerificationSend fails with ErrResendTooSoon if the previous
+	// verification email went out less than interval ago.
+	ClaimVerificationSend(ctx context.Context, userID string, interval time.Duration) error
+
+	SetPendingTOTPSecret(ctx context.Context, userID, secret string) error
+	EnableTwoFactor(ctx context.Context, userID, secret string, counter int64, recoveryHashes []string) error
+	DisableTwoFactor(ctx context.Context, userID string) error
+	// ClaimTOTPCounter fails with ErrCodeAlreadyUsed unless counter is later
+	// than every step accepted before.
+	ClaimTOTPCounter(ctx context.Context, userID string, counter int64) error
+	UseRecoveryCode(ctx context.Context, userID, codeHash string) error
+
+	RecordLoginFailure(ctx context.Context, user *models.User, policy ratelimit.Policy) (lockedUntil time.Time, locked bool, err error)
+	UnlockAccount(ctx context.Context, userID string) error
+
+	ListAddresses(ctx context.Context, userID string) ([]models.Address, error)
+	GetAddress(ctx context.Context, userID string, addressID primitive.ObjectID) (models.Address, error)
+	AddAddress(ctx context.Context, userID string, address *models.Address, limit int) error
+	UpdateAddress(ctx context.Context, userID string, addressID primitive.ObjectID, address models.Address) error
+	DeleteAddress(ctx context.Context, userID string, addressID primitive.ObjectID) error
+	SetDefaultAddress(ctx context.Context, userID string, addressID primitive.ObjectID, usage string) error
+}
+
+type ProductRepository interface {
+	AddProduct(ctx context.Context, product *models.Product) error
+	GetProduct(ctx context.Context, productID primitive.ObjectID) (models.Product, error)
+	ListProducts(ctx context.Context) ([]models.Product, error)
+}
+
+type CartRepository interface {
+	// AddItem reports whether the cart was empty before, i.e. whether the
+	// item started a new cart.
+	AddItem(ctx context.Context, userID string, item models.ProductInCart) (created bool, err error)
+	// RemoveItem drops every unit of the product from the cart.
+	RemoveItem(ctx context.Context, userID string, productID primitive.ObjectID) error
+}
+
+type OrderRepository interface {
+	// PlaceOrder records the order and, with emptyCart, clears the cart it
+	// was made from. It then fails with ErrCartChanged, recording nothing,
+	// unless the cart still holds exactly the lines of the order.
+	PlaceOrder(ctx context.Context, userID string, order *models.Order, emptyCart bool) error
+	GetOrder(ctx context.Context, userID string, orderID primitive.ObjectID) (models.Order, error)
+	// FindOrder looks the order up among all users and returns its owner.
+	FindOrder(ctx context.Context, orderID primitive.ObjectID) (userID string, order models.Order, err error)
+}
+
+// SessionRepository keeps the logins of every device.
+type SessionRepository interface {
+	CreateSession(ctx context.Context, userID, userAgent, ip string, ttl time.Duration) (models.Session, error)
+	// ListSessions returns the live sessions of the user, most recently used first.
+	ListSessions(ctx context.Context, userID string) ([]models.Session, error)
+	// TouchSession fails with ErrSessionRevoked unless the session is live,
+	// and records the activity.
+	TouchSession(ctx context.Context, sessionID, userID, ip string) error
+	RevokeSession(ctx context.Context, userID string, sessionID primitive.ObjectID) error
+	RevokeAllSessions(ctx context.Context, userID string) error
+}
+
+// OneTimeTokenRepository keeps the hashes of the tokens sent in emailed
+// links.
+type OneTimeTokenRepository interface {
+	// SaveOneTimeToken voids the earlier unused tokens of the user for
+	// purpose, so only the latest link works. email is the address the link
+	// goes to.
+	SaveOneTimeToken(ctx context.Context, userID, email, purpose, tokenHash string, ttl time.Duration) error
+	// ConsumeOneTimeToken returns a live token and fails with
+	// ErrInvalidOneTimeToken on its second use.
+	ConsumeOneTimeToken(ctx context.Context, purpose, tokenHash string) (models.OneTimeToken, error)
+}
+
+type APIKeyRepository interface {
+	CreateAPIKey(ctx context.Context, key *models.APIKey) error
+	ListAPIKeys(ctx context.Context) ([]models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, keyID primitive.ObjectID) error
+	// UseAPIKey fails with ErrInvalidAPIKey unless the key is live, and
+	// records its use.
+	UseAPIKey(ctx context.Context, keyHash string) (models.APIKey, error)
+}
+
+type ShipmentRepository interface {
+	// AddShipment records the shipment unless it fails CheckShipmentFits
+	// against ordered and the earlier shipments of the order. The check and
+	// the insert are atomic, so concurrent shipments cannot overship.
+	AddShipment(ctx context.Context, shipment *models.Shipment, ordered map[primitive.ObjectID]int) error
+	// AddTrackingEvent fails with ErrShipmentAlreadyClosed once the shipment
+	// is delivered.
+	AddTrackingEvent(ctx context.Context, shipmentID primitive.ObjectID, event models.TrackingEvent) error
+	OrderShipments(ctx context.Context, orderID primitive.ObjectID) ([]models.Shipment, error)
+}
+
+// CartItem is the cart line for one unit of product.
+func CartItem(product models.Product) models.ProductInCart {
+	return models.ProductInCart{
+		ProductID:   product.ProductID,
+		ProductName: product.ProductName,
+		Price:       product.Price,
+		Rating:      uint(product.Rating),
+		Image:       product.Image,
+		Category:    product.Category,
+		Weight:      product.Weight,
+		Dimensions:  product.Dimensions,
+	}
+}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// lastSeenPrecision limits how often a busy session is written to.
+const lastSeenPrecision = time.Minute
+
+var (
+	ErrCantFindSession   = errors.New("session not found")
+	ErrSessionRevoked    = errors.New("session has been revoked or has expired")
+	ErrCantCreateSession = errors.New("cannot create the session")
+)
+
+func SessionData(db *mongo.Database, collectionName string) *mongo.Collection {
+	var sessionCollection = db.Collection(collectionName)
+
+	return sessionCollection
+}
+
+func EnsureSessionIndexes(ctx context.Context, sessionCollection *mongo.Collection) error {
+	ctx, span := startSpan(ctx, "database.EnsureSessionIndexes")
+	defer span.End()
+
+	_, err := sessionCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "last_seen_at", Value: -1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot ensure session indexes", "error", err)
+		return ErrCantCreateIndexes
+	}
+
+	return nil
+}
+
+// MongoSessions keeps one document per session.
+type MongoSessions struct {
+	collection *mongo.Collection
+}
+
+func NewMongoSessions(sessionCollection *mongo.Collection) *MongoSessions {
+	return &MongoSessions{collection: sessionCollection}
+}
+
+func (sessions *MongoSessions) CreateSession(ctx context.Context,
+	userID, userAgent, ip string, ttl time.Duration) (models.Session, error) {
+	ctx, span := startSpan(ctx, "database.MongoSessions.CreateSession")
+	defer span.End()
+
+	now := time.Now()
+	session := models.Session{
+		SessionID:  primitive.NewObjectID(),
+		UserID:     userID,
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+
+	if _, err := sessions.collection.InsertOne(ctx, session); err != nil {
+		logging.FromContext(ctx).Error("cannot create session", "error", err)
+		return models.Session{}, ErrCantCreateSession
+	}
+
+	return session, nil
+}
+
+// ListSessions returns the live sessions of the user, most recently used first.
+func (sessions *MongoSessions) ListSessions(ctx context.Context, userID string) ([]models.Session, error) {
+	ctx, span := startSpan(ctx, "database.MongoSessions.ListSessions")
+	defer span.End()
+
+	cursor, err := sessions.collection.Find(ctx,
+		bson.M{"user_id": userID, "revoked_at": nil, "expires_at": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "last_seen_at", Value: -1}}))
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot list sessions", "error", err)
+		return nil, ErrCantFindSession
+	}
+
+	live := make([]models.Session, 0)
+	if err = cursor.All(ctx, &live); err != nil {
+		logging.FromContext(ctx).Error("cannot list sessions", "error", err)
+		return nil, ErrCantFindSession
+	}
+
+	return live, nil
+}
+
+// TouchSession checks that the session is live and records the activity.
+func (sessions *MongoSessions) TouchSession(ctx context.Context, sessionID, userID, ip string) error {
+	ctx, span := startSpan(ctx, "database.MongoSessions.TouchSession")
+	defer span.End()
+
+	id, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return ErrSessionRevoked
+	}
+
+	now := time.Now()
+	var session models.Session
+	err = sessions.collection.FindOne(ctx,
+		bson.M{"_id": id, "user_id": userID, "revoked_at": nil, "expires_at": bson.M{"$gt": now}}).Decode(&session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrSessionRevoked
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot touch session", "error", err)
+		return err
+	}
+
+	if now.Sub(session.LastSeenAt) < lastSeenPrecision && session.IP == ip {
+		return nil
+	}
+
+	_, err = sessions.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"last_seen_at": now, "ip": ip}})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot touch session", "error", err)
+	}
+
+	return nil
+}
+
+func (sessions *MongoSessions) RevokeSession(ctx context.Context, userID string, sessionID primitive.ObjectID) error {
+	ctx, span := startSpan(ctx, "database.MongoSessions.RevokeSession")
+	defer span.End()
+
+	res, err := sessions.collection.UpdateOne(ctx,
+		bson.M{"_id": sessionID, "user_id": userID, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot revoke session", "error", err)
+		return ErrCantFindSession
+	}
+	if res.MatchedCount == 0 {
+		return ErrCantFindSession
+	}
+
+	return nil
+}
+
+func (sessions *MongoSessions) RevokeAllSessions(ctx context.Context, userID string) error {
+	ctx, span := startSpan(ctx, "database.MongoSessions.RevokeAllSessions")
+	defer span.End()
+
+	_, err := sessions.collection.UpdateMany(ctx,
+		bson.M{"user_id": userID, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot revoke all sessions", "error", err)
+		return ErrCantFindSession
+	}
+
+	return nil
+}
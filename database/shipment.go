@@ -0,0 +1,246 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+var (
+	ErrCantFindOrder         = errors.New("cannot find the order")
+	ErrCantFindShipment      = errors.New("cannot find the shipment")
+	ErrShipmentExceedsOrder  = errors.New("shipment contains more items than left to ship")
+	ErrCantCreateShipment    = errors.New("cannot create the shipment")
+	ErrCantAddTrackingEvent  = errors.New("cannot add the tracking event")
+	ErrCantDecodeShipments   = errors.New("cannot decode shipments")
+	ErrShipmentAlreadyClosed = errors.New("shipment is already delivered")
+)
+
+func ShipmentData(db *mongo.Database, collectionName string) *mongo.Collection {
+	var shipmentCollection = db.Collection(collectionName)
+
+	return shipmentCollection
+}
+
+// MongoShipments keeps one document per shipment, and one per order with
+// the units shipped of each product, which is what new shipments are checked
+// against.
+type MongoShipments struct {
+	collection *mongo.Collection
+	counts     *mongo.Collection
+}
+
+func NewMongoShipments(shipmentCollection, countCollection *mongo.Collection) *MongoShipments {
+	return &MongoShipments{collection: shipmentCollection, counts: countCollection}
+}
+
+// shippedCount is keyed by the order; Shipped by the hex product IDs.
+type shippedCount struct {
+	OrderID primitive.ObjectID `bson:"_id"`
+	Shipped map[string]int     `bson:"shipped"`
+}
+
+// CreateShipment ships items of an order to its owner. It fails with
+// ErrShipmentExceedsOrder if the items, together with the shipments made
+// before, are more than the order holds.
+func CreateShipment(ctx context.Context, orders OrderRepository, shipments ShipmentRepository, shipment *models.Shipment) error {
+	ctx, span := startSpan(ctx, "database.CreateShipment")
+	defer span.End()
+
+	ownerID, order, err := orders.FindOrder(ctx, shipment.OrderID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	shipment.ShipmentID = primitive.NewObjectID()
+	shipment.UserID = ownerID
+	shipment.Status = models.ShipmentLabelCreated
+	shipment.Events = []models.TrackingEvent{{Status: models.ShipmentLabelCreated, OccurredAt: now}}
+	shipment.CreatedAt = now
+	shipment.UpdatedAt = now
+
+	return shipments.AddShipment(ctx, shipment, OrderedQuantities(&order))
+}
+
+// AddShipment claims the units of the shipment with one conditional $inc on
+// the shipped counts of the order, so concurrent shipments cannot together
+// ship more than ordered, and then stores the shipment.
+func (shipments *MongoShipments) AddShipment(ctx context.Context, shipment *models.Shipment, ordered map[primitive.ObjectID]int) error {
+	ctx, span := startSpan(ctx, "database.MongoShipments.AddShipment")
+	defer span.End()
+
+	// The shipment alone must fit before its units are claimed.
+	if err := CheckShipmentFits(ordered, nil, shipment); err != nil {
+		return err
+	}
+	if err := shipments.seedCounts(ctx, shipment.OrderID); err != nil {
+		return err
+	}
+
+	filter := bson.M{"_id": shipment.OrderID}
+	claim, release := bson.M{}, bson.M{}
+	for productID, quantity := range shipmentQuantities(shipment) {
+		key := "shipped." + productID.Hex()
+		filter[key] = bson.M{"$not": bson.M{"$gt": ordered[productID] - quantity}}
+		claim[key] = quantity
+		release[key] = -quantity
+	}
+
+	res, err := shipments.counts.UpdateOne(ctx, filter, bson.M{"$inc": claim})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot create shipment", "error", err)
+		return ErrCantCreateShipment
+	}
+	if res.MatchedCount == 0 {
+		return ErrShipmentExceedsOrder
+	}
+
+	_, err = shipments.collection.InsertOne(ctx, shipment)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot create shipment", "error", err)
+		_, releaseErr := shipments.counts.UpdateOne(context.WithoutCancel(ctx),
+			bson.M{"_id": shipment.OrderID}, bson.M{"$inc": release})
+		if releaseErr != nil {
+			logging.FromContext(ctx).Error("cannot release the units of a failed shipment", "error", releaseErr)
+		}
+		return ErrCantCreateShipment
+	}
+
+	return nil
+}
+
+// seedCounts creates the shipped counts of an order from the shipments made
+// before the counts were kept. Shipments are only added once the counts
+// exist, so concurrent seeds count the same and all but one are dropped.
+func (shipments *MongoShipments) seedCounts(ctx context.Context, orderID primitive.ObjectID) error {
+	err := shipments.counts.FindOne(ctx, bson.M{"_id": orderID}).Err()
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		logging.FromContext(ctx).Error("cannot read shipped counts", "error", err)
+		return ErrCantCreateShipment
+	}
+
+	existing, err := shipments.OrderShipments(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	count := shippedCount{OrderID: orderID, Shipped: make(map[string]int)}
+	for i := range existing {
+		for productID, quantity := range shipmentQuantities(&existing[i]) {
+			count.Shipped[productID.Hex()] += quantity
+		}
+	}
+
+	_, err = shipments.counts.InsertOne(ctx, count)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		logging.FromContext(ctx).Error("cannot seed shipped counts", "error", err)
+		return ErrCantCreateShipment
+	}
+
+	return nil
+}
+
+// shipmentQuantities adds up the items of a shipment per product.
+func shipmentQuantities(shipment *models.Shipment) map[primitive.ObjectID]int {
+	quantities := make(map[primitive.ObjectID]int)
+	for _, item := range shipment.Items {
+		quantities[item.ProductID] += item.Quantity
+	}
+
+	return quantities
+}
+
+func (shipments *MongoShipments) AddTrackingEvent(ctx context.Context,
+	shipmentID primitive.ObjectID, event models.TrackingEvent) error {
+	ctx, span := startSpan(ctx, "database.MongoShipments.AddTrackingEvent")
+	defer span.End()
+
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now()
+	}
+
+	filter := bson.M{"_id": shipmentID, "status": bson.M{"$ne": models.ShipmentDelivered}}
+	update := bson.M{
+		"$push": bson.M{"events": event},
+		"$set":  bson.M{"status": event.Status, "updated_at": time.Now()},
+	}
+	res, err := shipments.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot add tracking event", "error", err)
+		return ErrCantAddTrackingEvent
+	}
+
+	if res.MatchedCount == 0 {
+		count, err := shipments.collection.CountDocuments(ctx, bson.M{"_id": shipmentID})
+		if err != nil {
+			logging.FromContext(ctx).Error("cannot add tracking event", "error", err)
+			return ErrCantAddTrackingEvent
+		}
+		if count == 0 {
+			return ErrCantFindShipment
+		}
+		return ErrShipmentAlreadyClosed
+	}
+
+	return nil
+}
+
+func (shipments *MongoShipments) OrderShipments(ctx context.Context, orderID primitive.ObjectID) ([]models.Shipment, error) {
+	ctx, span := startSpan(ctx, "database.MongoShipments.OrderShipments")
+	defer span.End()
+
+	cursor, err := shipments.collection.Find(ctx, bson.M{"order_id": orderID})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot list order shipments", "error", err)
+		return nil, ErrCantDecodeShipments
+	}
+
+	found := make([]models.Shipment, 0)
+	if err = cursor.All(ctx, &found); err != nil {
+		logging.FromContext(ctx).Error("cannot list order shipments", "error", err)
+		return nil, ErrCantDecodeShipments
+	}
+
+	return found, nil
+}
+
+// OrderedQuantities counts line items per product, since the cart keeps one
+// entry for every unit added.
+func OrderedQuantities(order *models.Order) map[primitive.ObjectID]int {
+	quantities := make(map[primitive.ObjectID]int)
+	for _, item := range order.OrderCart {
+		quantities[item.ProductID]++
+	}
+
+	return quantities
+}
+
+// CheckShipmentFits fails with ErrShipmentExceedsOrder if shipment, together
+// with the shipments made before, ships more of a product than ordered.
+func CheckShipmentFits(ordered map[primitive.ObjectID]int, existing []models.Shipment, shipment *models.Shipment) error {
+	remaining := make(map[primitive.ObjectID]int, len(ordered))
+	for productID, quantity := range ordered {
+		remaining[productID] = quantity
+	}
+	for _, earlier := range existing {
+		for _, item := range earlier.Items {
+			remaining[item.ProductID] -= item.Quantity
+		}
+	}
+	for _, item := range shipment.Items {
+		remaining[item.ProductID] -= item.Quantity
+		if remaining[item.ProductID] < 0 {
+			return ErrShipmentExceedsOrder
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+package database
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/koinav/ecommerce/database"
+
+// startSpan starts a span for a database function. The tracer comes from the
+// span already in ctx, usually the one of the HTTP request, so no global
+// provider is needed; without such a span nothing is recorded. Failed
+// commands are marked on the MongoDB command spans below this one.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(instrumentationName).Start(ctx, name)
+}
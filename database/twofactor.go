@@ -0,0 +1,123 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/koinav/ecommerce/logging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+var (
+	ErrTwoFactorNotPending = errors.New("two-factor enrolment was not started")
+	ErrCodeAlreadyUsed     = errors.New("code was already used")
+	ErrInvalidRecoveryCode = errors.New("recovery code is invalid")
+)
+
+func (users *MongoUsers) SetPendingTOTPSecret(ctx context.Context, userID, secret string) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.SetPendingTOTPSecret")
+	defer span.End()
+
+	return users.update(ctx, userID, bson.M{"totp_pending_secret": secret})
+}
+
+// EnableTwoFactor promotes the pending secret and replaces the recovery codes.
+// counter is the step of the code that confirmed the enrolment.
+func (users *MongoUsers) EnableTwoFactor(ctx context.Context,
+	userID, secret string, counter int64, recoveryHashes []string) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.EnableTwoFactor")
+	defer span.End()
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot enable two-factor authentication", "error", err)
+		return ErrUserIdIsNotValid
+	}
+
+	res, err := users.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "totp_pending_secret": secret},
+		bson.M{
+			"$set": bson.M{
+				"two_factor_enabled": true,
+				"totp_secret":        secret,
+				"totp_last_counter":  counter,
+				"recovery_codes":     recoveryHashes,
+				"updatedat":          time.Now(),
+			},
+			"$unset": bson.M{"totp_pending_secret": ""},
+		})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot enable two-factor authentication", "error", err)
+		return ErrCantUpdateProfile
+	}
+	if res.MatchedCount == 0 {
+		return ErrTwoFactorNotPending
+	}
+
+	return nil
+}
+
+func (users *MongoUsers) DisableTwoFactor(ctx context.Context, userID string) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.DisableTwoFactor")
+	defer span.End()
+
+	return users.update(ctx, userID, bson.M{
+		"two_factor_enabled":  false,
+		"totp_secret":         "",
+		"totp_pending_secret": "",
+		"totp_last_counter":   int64(0),
+		"recovery_codes":      []string{},
+	})
+}
+
+// ClaimTOTPCounter records the step of an accepted code. It fails if that
+// step or a later one was used already, so a code cannot be replayed.
+func (users *MongoUsers) ClaimTOTPCounter(ctx context.Context, userID string, counter int64) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.ClaimTOTPCounter")
+	defer span.End()
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot claim TOTP step", "error", err)
+		return ErrUserIdIsNotValid
+	}
+
+	res, err := users.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "totp_last_counter": bson.M{"$lt": counter}},
+		bson.M{"$set": bson.M{"totp_last_counter": counter}})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot claim TOTP step", "error", err)
+		return ErrCantUpdateProfile
+	}
+	if res.MatchedCount == 0 {
+		return ErrCodeAlreadyUsed
+	}
+
+	return nil
+}
+
+// UseRecoveryCode removes the code so that each one works only once.
+func (users *MongoUsers) UseRecoveryCode(ctx context.Context, userID, codeHash string) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.UseRecoveryCode")
+	defer span.End()
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot use recovery code", "error", err)
+		return ErrUserIdIsNotValid
+	}
+
+	res, err := users.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "recovery_codes": codeHash},
+		bson.M{"$pull": bson.M{"recovery_codes": codeHash}})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot use recovery code", "error", err)
+		return ErrCantUpdateProfile
+	}
+	if res.ModifiedCount == 0 {
+		return ErrInvalidRecoveryCode
+	}
+
+	return nil
+}
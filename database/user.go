@@ -0,0 +1,306 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+	"time"
+)
+
+var (
+	ErrEmailTaken        = errors.New("email is already in use")
+	ErrPhoneTaken        = errors.New("phone is already in use")
+	ErrIdentityTaken     = errors.New("external account is already linked to a user")
+	ErrCantUpdateProfile = errors.New("cannot update the user")
+	ErrCantCreateIndexes = errors.New("cannot create indexes")
+
+	ErrEmailAlreadyVerified = errors.New("email is already verified")
+	ErrResendTooSoon        = errors.New("verification email was sent recently, try again later")
+	ErrEmailChanged         = errors.New("the link was sent to an email the account no longer uses")
+)
+
+// EnsureUserIndexes backs the uniqueness checks of sign up and profile
+// changes, which are racy on their own.
+func EnsureUserIndexes(ctx context.Context, userCollection *mongo.Collection) error {
+	ctx, span := startSpan(ctx, "database.EnsureUserIndexes")
+	defer span.End()
+
+	_, err := userCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"email": bson.M{"$type": "string"}})},
+		{Keys: bson.D{{Key: "phone", Value: 1}}, Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"phone": bson.M{"$type": "string"}})},
+		{Keys: bson.D{{Key: "identities.issuer", Value: 1}, {Key: "identities.subject", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"identities.subject": bson.M{"$type": "string"}})},
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot ensure user indexes", "error", err)
+		return ErrCantCreateIndexes
+	}
+
+	return nil
+}
+
+// MongoUsers keeps users in a MongoDB collection, one document per user
+// with the cart, addresses and orders embedded.
+type MongoUsers struct {
+	collection *mongo.Collection
+}
+
+func NewMongoUsers(userCollection *mongo.Collection) *MongoUsers {
+	return &MongoUsers{collection: userCollection}
+}
+
+func (users *MongoUsers) CreateUser(ctx context.Context, user *models.User) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.CreateUser")
+	defer span.End()
+
+	if user.Email != "" {
+		if err := users.checkUnique(ctx, user.ID, "email", user.Email, ErrEmailTaken); err != nil {
+			return err
+		}
+	}
+	if user.Phone != "" {
+		if err := users.checkUnique(ctx, user.ID, "phone", user.Phone, ErrPhoneTaken); err != nil {
+			return err
+		}
+	}
+
+	_, err := users.collection.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return duplicateUserError(err)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot create user", "error", err)
+		return ErrCantCreateUser
+	}
+
+	return nil
+}
+
+func (users *MongoUsers) GetUser(ctx context.Context, userID string) (models.User, error) {
+	ctx, span := startSpan(ctx, "database.MongoUsers.GetUser")
+	defer span.End()
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot get user", "error", err)
+		return models.User{}, ErrUserIdIsNotValid
+	}
+
+	var user models.User
+	err = users.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot get user", "error", err)
+		return models.User{}, ErrCantFindUser
+	}
+
+	return user, nil
+}
+
+func (users *MongoUsers) FindUserByEmail(ctx context.Context, email string) (models.User, error) {
+	ctx, span := startSpan(ctx, "database.MongoUsers.FindUserByEmail")
+	defer span.End()
+
+	var user models.User
+	err := users.collection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.User{}, ErrCantFindUser
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot find user by email", "error", err)
+		return models.User{}, ErrCantReadUser
+	}
+
+	return user, nil
+}
+
+func (users *MongoUsers) UpdateName(ctx context.Context, userID, firstName, lastName string) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.UpdateName")
+	defer span.End()
+
+	return users.update(ctx, userID, bson.M{"firstname": firstName, "lastname": lastName})
+}
+
+func (users *MongoUsers) ChangeEmail(ctx context.Context, userID, email string) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.ChangeEmail")
+	defer span.End()
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot change email", "error", err)
+		return ErrUserIdIsNotValid
+	}
+	if err = users.checkUnique(ctx, id, "email", email, ErrEmailTaken); err != nil {
+		return err
+	}
+
+	return users.update(ctx, userID, bson.M{
+		"email":                email,
+		"email_verified":       false,
+		"verification_sent_at": time.Time{},
+	})
+}
+
+func (users *MongoUsers) ChangePhone(ctx context.Context, userID, phone string) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.ChangePhone")
+	defer span.End()
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot change phone", "error", err)
+		return ErrUserIdIsNotValid
+	}
+	if err = users.checkUnique(ctx, id, "phone", phone, ErrPhoneTaken); err != nil {
+		return err
+	}
+
+	return users.update(ctx, userID, bson.M{"phone": phone})
+}
+
+func (users *MongoUsers) ChangePassword(ctx context.Context, userID, hashedPassword string) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.ChangePassword")
+	defer span.End()
+
+	return users.update(ctx, userID, bson.M{"password": hashedPassword})
+}
+
+// ResetPassword sets a new password and revokes every token issued before,
+// logging the user out everywhere.
+func (users *MongoUsers) ResetPassword(ctx context.Context, userID, hashedPassword string) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.ResetPassword")
+	defer span.End()
+
+	return users.update(ctx, userID, bson.M{
+		"password":          hashedPassword,
+		"token":             "",
+		"refreshtoken":      "",
+		"tokens_revoked_at": time.Now(),
+	})
+}
+
+func (users *MongoUsers) UpdateTokens(ctx context.Context, userID, token, refreshToken string) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.UpdateTokens")
+	defer span.End()
+
+	return users.update(ctx, userID, bson.M{"token": token, "refreshtoken": refreshToken})
+}
+
+// MarkEmailVerified verifies email only while it is still the address of the
+// user, so a link sent before an email change cannot verify the new one.
+func (users *MongoUsers) MarkEmailVerified(ctx context.Context, userID, email string) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.MarkEmailVerified")
+	defer span.End()
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot update user", "error", err)
+		return ErrUserIdIsNotValid
+	}
+
+	res, err := users.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "email": email},
+		bson.M{"$set": bson.M{"email_verified": true, "updatedat": time.Now()}})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot update user", "error", err)
+		return ErrCantUpdateProfile
+	}
+	if res.MatchedCount == 0 {
+		return ErrEmailChanged
+	}
+
+	return nil
+}
+
+// ClaimVerificationSend records that a verification email is going out and
+// fails if the previous one was sent less than interval ago, so the resend
+// endpoint cannot be used to flood a mailbox.
+func (users *MongoUsers) ClaimVerificationSend(ctx context.Context, userID string, interval time.Duration) error {
+	ctx, span := startSpan(ctx, "database.MongoUsers.ClaimVerificationSend")
+	defer span.End()
+
+	user, err := users.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.EmailVerified {
+		return ErrEmailAlreadyVerified
+	}
+
+	now := time.Now()
+	filter := bson.M{
+		"_id":            user.ID,
+		"email_verified": bson.M{"$ne": true},
+		"$or": bson.A{
+			bson.M{"verification_sent_at": bson.M{"$exists": false}},
+			bson.M{"verification_sent_at": bson.M{"$lte": now.Add(-interval)}},
+		},
+	}
+
+	res, err := users.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"verification_sent_at": now}})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot claim verification send", "error", err)
+		return ErrCantUpdateProfile
+	}
+	if res.MatchedCount == 0 {
+		return ErrResendTooSoon
+	}
+
+	return nil
+}
+
+// duplicateUserError tells which unique index of EnsureUserIndexes a
+// duplicate key error hit; the index name is only in the server message.
+func duplicateUserError(err error) error {
+	switch message := err.Error(); {
+	case strings.Contains(message, "phone_1"):
+		return ErrPhoneTaken
+	case strings.Contains(message, "identities.issuer_1"):
+		return ErrIdentityTaken
+	}
+
+	return ErrEmailTaken
+}
+
+func (users *MongoUsers) checkUnique(ctx context.Context, id primitive.ObjectID, field, value string, taken error) error {
+	count, err := users.collection.CountDocuments(ctx, bson.M{field: value, "_id": bson.M{"$ne": id}})
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot check uniqueness", "error", err)
+		return ErrCantUpdateProfile
+	}
+	if count > 0 {
+		return taken
+	}
+
+	return nil
+}
+
+func (users *MongoUsers) update(ctx context.Context, userID string, fields bson.M) error {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot update user", "error", err)
+		return ErrUserIdIsNotValid
+	}
+
+	fields["updatedat"] = time.Now()
+	res, err := users.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": fields})
+	if mongo.IsDuplicateKeyError(err) {
+		return duplicateUserError(err)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot update user", "error", err)
+		return ErrCantUpdateProfile
+	}
+	if res.MatchedCount == 0 {
+		return ErrCantFindUser
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package keyring
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEdDSA signs with Ed25519 keys (RFC 8037), which jwt-go does
+// not support out of the box.
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+type signingMethodEdDSA struct{}
+
+var errInvalidEdDSAKey = errors.New("key is not an Ed25519 key")
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (method *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (method *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", errInvalidEdDSAKey
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+func (method *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return errInvalidEdDSAKey
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+
+	return nil
+}
@@ -0,0 +1,239 @@
+// Package keyring manages the keys JWTs are signed with: a directory of
+// private keys scheduled by a manifest, rotated on time and published as a
+// JWKS.
+package keyring
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/koinav/ecommerce/logging"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ManifestFile lists the keys of a key directory together with the time each
+// of them starts signing.
+const ManifestFile = "keys.json"
+
+var (
+	ErrNoSigningKey = errors.New("no JWT signing key is configured")
+	ErrUnknownKey   = errors.New("token is signed with an unknown key")
+)
+
+// Key is a signing key of the ring. It signs from NotBefore until the next
+// key takes over, and its public part is kept for verification for the
+// overlap period after that, so that the tokens it signed stay valid.
+type Key struct {
+	ID        string
+	Method    jwt.SigningMethod
+	NotBefore time.Time
+	RetiresAt time.Time
+
+	private crypto.PrivateKey
+	public  crypto.PublicKey
+}
+
+func (key *Key) PrivateKey() crypto.PrivateKey {
+	return key.private
+}
+
+func (key *Key) PublicKey() crypto.PublicKey {
+	return key.public
+}
+
+type Manifest struct {
+	Keys []ManifestKey `json:"keys"`
+}
+
+type ManifestKey struct {
+	ID        string    `json:"kid"`
+	File      string    `json:"file"`
+	NotBefore time.Time `json:"not_before"`
+}
+
+// Ring holds the keys of a key directory. New keys are put in the
+// directory ahead of their NotBefore, so that they are published in the JWKS
+// before anything is signed with them, and the ring rotates to them on
+// schedule.
+type Ring struct {
+	mu      sync.RWMutex
+	dir     string
+	overlap time.Duration
+	keys    []*Key
+}
+
+// Load reads the keys listed in the manifest of dir. overlap is how
+// long a replaced key still verifies tokens; it should be at least the
+// lifetime of the longest living token.
+func Load(dir string, overlap time.Duration) (*Ring, error) {
+	ring := &Ring{dir: dir, overlap: overlap}
+	if err := ring.Reload(); err != nil {
+		return nil, err
+	}
+
+	return ring, nil
+}
+
+func (ring *Ring) Reload() error {
+	manifest, err := ReadManifest(ring.dir)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*Key, 0, len(manifest.Keys))
+	seen := make(map[string]bool)
+	for _, entry := range manifest.Keys {
+		if entry.ID == "" || seen[entry.ID] {
+			return fmt.Errorf("key ring: missing or duplicate kid %q", entry.ID)
+		}
+		seen[entry.ID] = true
+
+		key, err := readKey(filepath.Join(ring.dir, entry.File))
+		if err != nil {
+			return fmt.Errorf("key ring: key %q: %w", entry.ID, err)
+		}
+		key.ID = entry.ID
+		key.NotBefore = entry.NotBefore
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].NotBefore.Before(keys[j].NotBefore) })
+	for i := 0; i+1 < len(keys); i++ {
+		keys[i].RetiresAt = keys[i+1].NotBefore.Add(ring.overlap)
+	}
+
+	if len(keys) == 0 || keys[0].NotBefore.After(time.Now()) {
+		return ErrNoSigningKey
+	}
+
+	ring.mu.Lock()
+	ring.keys = keys
+	ring.mu.Unlock()
+
+	return nil
+}
+
+// Watch reloads the ring every interval until ctx is done. A broken reload
+// keeps the keys loaded before.
+func (ring *Ring) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ring.Reload(); err != nil {
+				logging.FromContext(ctx).Error("cannot reload signing keys", "error", err)
+			}
+		}
+	}
+}
+
+// SigningKey returns the newest key that is due at now.
+func (ring *Ring) SigningKey(now time.Time) (*Key, error) {
+	ring.mu.RLock()
+	defer ring.mu.RUnlock()
+
+	for i := len(ring.keys) - 1; i >= 0; i-- {
+		if !ring.keys[i].NotBefore.After(now) {
+			return ring.keys[i], nil
+		}
+	}
+
+	return nil, ErrNoSigningKey
+}
+
+// VerificationKey returns the key with the kid unless it has retired.
+func (ring *Ring) VerificationKey(kid string, now time.Time) (*Key, error) {
+	ring.mu.RLock()
+	defer ring.mu.RUnlock()
+
+	for _, key := range ring.keys {
+		if key.ID == kid && (key.RetiresAt.IsZero() || now.Before(key.RetiresAt)) {
+			return key, nil
+		}
+	}
+
+	return nil, ErrUnknownKey
+}
+
+// Published returns the keys that others should accept at now: the ones
+// still verifying and the upcoming ones.
+func (ring *Ring) Published(now time.Time) []*Key {
+	ring.mu.RLock()
+	defer ring.mu.RUnlock()
+
+	var keys []*Key
+	for _, key := range ring.keys {
+		if key.RetiresAt.IsZero() || now.Before(key.RetiresAt) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func ReadManifest(dir string) (Manifest, error) {
+	var manifest Manifest
+
+	raw, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return manifest, err
+	}
+
+	if err = json.Unmarshal(raw, &manifest); err != nil {
+		return manifest, fmt.Errorf("key ring: %s: %w", ManifestFile, err)
+	}
+
+	return manifest, nil
+}
+
+// readKey reads a PEM private key: RSA keys sign with RS256 and Ed25519 keys
+// with EdDSA.
+func readKey(path string) (*Key, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch private := parsed.(type) {
+	case *rsa.PrivateKey:
+		if private.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return &Key{Method: jwt.SigningMethodRS256, private: private, public: &private.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &Key{Method: SigningMethodEdDSA, private: private, public: private.Public()}, nil
+	default:
+		return nil, errors.New("only RSA and Ed25519 keys are supported")
+	}
+}
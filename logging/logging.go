@@ -0,0 +1,45 @@
+// Package logging builds the structured logger of the server and carries the
+// request scoped logger, with the request ID and user ID as attributes, in
+// a context.Context down to the database functions.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+type contextKey int
+
+const loggerKey contextKey = 0
+
+// New returns a logger writing to out. format is json or text, level one of
+// debug, info, warn and error.
+func New(out io.Writer, format, level string) *slog.Logger {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+
+	options := &slog.HandlerOptions{Level: lvl}
+	if strings.EqualFold(format, "text") {
+		return slog.New(slog.NewTextHandler(out, options))
+	}
+
+	return slog.New(slog.NewJSONHandler(out, options))
+}
+
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// FromContext returns the logger put into ctx by NewContext, or the default
+// logger for code that runs outside of a request.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
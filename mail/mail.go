@@ -0,0 +1,20 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrCantSendMail = errors.New("cannot send the email")
+
+type Message struct {
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+type Sender interface {
+	Send(ctx context.Context, message Message) error
+}
@@ -0,0 +1,73 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/koinav/ecommerce/logging"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileSender appends every message as a JSON line to a file instead of
+// delivering it, so links from emails can be picked up in local development.
+type FileSender struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileSender(path string) *FileSender {
+	return &FileSender{path: path}
+}
+
+func (sender *FileSender) Send(ctx context.Context, message Message) error {
+	message.SentAt = time.Now()
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+
+	file, err := os.OpenFile(sender.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		logging.FromContext(ctx).Error("cannot open mail file", "error", err)
+		return ErrCantSendMail
+	}
+	defer file.Close()
+
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		logging.FromContext(ctx).Error("cannot write mail file", "error", err)
+		return ErrCantSendMail
+	}
+
+	return nil
+}
+
+// MemorySender keeps messages in memory for tests.
+type MemorySender struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemorySender() *MemorySender {
+	return &MemorySender{}
+}
+
+func (sender *MemorySender) Send(_ context.Context, message Message) error {
+	message.SentAt = time.Now()
+
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	sender.messages = append(sender.messages, message)
+
+	return nil
+}
+
+func (sender *MemorySender) Messages() []Message {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+
+	return append([]Message(nil), sender.messages...)
+}
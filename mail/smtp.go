@@ -0,0 +1,52 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"github.com/koinav/ecommerce/logging"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+type SMTPSender struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTPSender(host, port, username, password, from string) *SMTPSender {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &SMTPSender{addr: net.JoinHostPort(host, port), auth: auth, from: from}
+}
+
+func (sender *SMTPSender) Send(ctx context.Context, message Message) error {
+	if strings.ContainsAny(message.To, "\r\n") || strings.ContainsAny(message.Subject, "\r\n") {
+		return ErrCantSendMail
+	}
+
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n"+
+		"MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		sender.from, message.To, message.Subject, time.Now().Format(time.RFC1123Z), message.Body)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(sender.addr, sender.auth, sender.from, []string{message.To}, []byte(body))
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			logging.FromContext(ctx).Error("cannot send mail over SMTP", "error", err)
+			return ErrCantSendMail
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,152 @@
+// Package metrics exposes Prometheus metrics of one server: HTTP requests by
+// route, MongoDB command latency and business events such as signups and
+// orders. Every Metrics has its own registry, so several servers can run in
+// one process.
+package metrics
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/money"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+	"math"
+	"strconv"
+	"time"
+)
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+	mongoCommand *prometheus.HistogramVec
+
+	signups      *prometheus.CounterVec
+	logins       prometheus.Counter
+	failedLogins prometheus.Counter
+	cartsCreated prometheus.Counter
+	ordersPlaced *prometheus.CounterVec
+	revenue      *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	metrics := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests by method, route and status code.",
+		}, []string{"method", "route", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Time to answer HTTP requests by method, route and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		mongoCommand: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mongodb_command_duration_seconds",
+			Help:    "Time MongoDB commands took by command and outcome.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"command", "outcome"}),
+		signups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ecommerce_signups_total",
+			Help: "Accounts created, by sign-up method.",
+		}, []string{"method"}),
+		logins: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ecommerce_logins_total",
+			Help: "Successful logins.",
+		}),
+		failedLogins: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ecommerce_failed_logins_total",
+			Help: "Rejected logins: wrong password, unknown email or wrong second factor.",
+		}),
+		cartsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ecommerce_carts_created_total",
+			Help: "Items added to an empty cart.",
+		}),
+		ordersPlaced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ecommerce_orders_placed_total",
+			Help: "Orders placed, by checkout kind.",
+		}, []string{"kind"}),
+		revenue: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ecommerce_revenue_total",
+			Help: "Total price of placed orders in major units, by currency.",
+		}, []string{"currency"}),
+	}
+
+	metrics.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metrics.httpRequests, metrics.httpDuration, metrics.mongoCommand,
+		metrics.signups, metrics.logins, metrics.failedLogins, metrics.cartsCreated,
+		metrics.ordersPlaced, metrics.revenue,
+	)
+
+	return metrics
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (metrics *Metrics) Handler() gin.HandlerFunc {
+	handler := promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+	return gin.WrapH(handler)
+}
+
+// HTTP counts and times requests. Routes are labelled with their pattern,
+// e.g. /admin/apikeys/:id, so that ids do not blow up the label values.
+func (metrics *Metrics) HTTP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+
+		metrics.httpRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+		metrics.httpDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// CommandMonitor times every command the MongoDB client sends.
+func (metrics *Metrics) CommandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			metrics.mongoCommand.WithLabelValues(e.CommandName, "success").Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			metrics.mongoCommand.WithLabelValues(e.CommandName, "failure").Observe(e.Duration.Seconds())
+		},
+	}
+}
+
+// Signup counts a new account; method is "password" or "oidc".
+func (metrics *Metrics) Signup(method string) {
+	metrics.signups.WithLabelValues(method).Inc()
+}
+
+func (metrics *Metrics) Login() {
+	metrics.logins.Inc()
+}
+
+func (metrics *Metrics) FailedLogin() {
+	metrics.failedLogins.Inc()
+}
+
+func (metrics *Metrics) CartCreated() {
+	metrics.cartsCreated.Inc()
+}
+
+// OrderPlaced counts the order and adds its total to the revenue; kind is
+// "cart" or "instant".
+func (metrics *Metrics) OrderPlaced(kind string, total money.Money) {
+	metrics.ordersPlaced.WithLabelValues(kind).Inc()
+
+	exp, err := money.Exponent(total.Currency)
+	if err != nil || total.Amount < 0 {
+		return
+	}
+	metrics.revenue.WithLabelValues(total.Currency).Add(float64(total.Amount) / math.Pow10(exp))
+}
@@ -1,27 +1,247 @@
 package middleware
 
 import (
+	"context"
 	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/money"
+	"github.com/koinav/ecommerce/ratelimit"
 	"github.com/koinav/ecommerce/tokens"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func Authentication() gin.HandlerFunc {
+// Auth authenticates requests with user tokens and API keys.
+type Auth struct {
+	issuer   *tokens.Issuer
+	users    database.UserRepository
+	sessions database.SessionRepository
+	apiKeys  database.APIKeyRepository
+}
+
+func NewAuth(issuer *tokens.Issuer, users database.UserRepository, sessions database.SessionRepository, apiKeys database.APIKeyRepository) *Auth {
+	return &Auth{
+		issuer:   issuer,
+		users:    users,
+		sessions: sessions,
+		apiKeys:  apiKeys,
+	}
+}
+
+// Authentication accepts access tokens whose session is still live, sent as
+// Authorization: Bearer (RFC 6750) or, for older clients, in the token header.
+func (auth *Auth) Authentication() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ClientToken := c.Request.Header.Get("token")
-		if ClientToken == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "No auth header provided"})
-			c.Abort()
+		token, ok := bearerToken(c)
+		if !ok {
+			return
+		}
+		if tokens.IsAPIKey(token) {
+			forbidden(c, "", "API keys cannot be used for this request")
+			return
+		}
+		if !auth.authenticateUser(c, token) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// Admin lets through admin users and, when scope is set, API keys granted
+// that scope. With require2FA admins must have logged in with a second factor.
+func (auth *Auth) Admin(require2FA bool, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := bearerToken(c)
+		if !ok {
+			return
+		}
+
+		if tokens.IsAPIKey(token) {
+			if scope == "" {
+				forbidden(c, "", "API keys cannot be used for this request")
+				return
+			}
+
+			var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+			defer cancel()
+
+			key, err := auth.apiKeys.UseAPIKey(ctx, tokens.HashOneTimeToken(token))
+			if err != nil {
+				unauthorized(c, "invalid_token", database.ErrInvalidAPIKey.Error())
+				return
+			}
+			if !key.HasScope(scope) {
+				forbidden(c, scope, "API key lacks the "+scope+" scope")
+				return
+			}
+
+			c.Set("api_key_id", key.KeyID.Hex())
+			withLogAttrs(c, "api_key_id", key.KeyID.Hex())
+			c.Next()
+			return
+		}
+
+		if !auth.authenticateUser(c, token) {
+			return
+		}
+		if c.GetString("role") != models.RoleAdmin {
+			forbidden(c, scope, "admin role required")
 			return
 		}
-		claims, err := tokens.ValidateToken(ClientToken)
+		if require2FA && !c.GetBool("two_factor") {
+			forbidden(c, scope, "two-factor authentication required for admins")
+			return
+		}
+		c.Next()
+	}
+}
+
+// bearerToken reads the credentials of the request. A malformed
+// Authorization header or missing credentials are answered right away.
+func bearerToken(c *gin.Context) (string, bool) {
+	token := c.Request.Header.Get("token")
+
+	if header := c.Request.Header.Get("Authorization"); header != "" {
+		scheme, credentials, found := strings.Cut(header, " ")
+		credentials = strings.TrimSpace(credentials)
+		if !found || !strings.EqualFold(scheme, "Bearer") || credentials == "" {
+			c.Header("WWW-Authenticate", challenge+`, error="invalid_request"`)
+			c.JSON(http.StatusBadRequest, errorBody(c, "Authorization header must be: Bearer <token>"))
+			c.Abort()
+			return "", false
+		}
+		token = credentials
+	}
+
+	if token == "" {
+		unauthorized(c, "", "authentication required")
+		return "", false
+	}
+
+	return token, true
+}
+
+func (auth *Auth) authenticateUser(c *gin.Context, token string) bool {
+	claims, err := auth.issuer.ValidateToken(token)
+	if err != nil {
+		unauthorized(c, "invalid_token", "token is invalid or expired")
+		return false
+	}
+	if claims.Scope != "" {
+		unauthorized(c, "invalid_token", "token cannot be used for this request")
+		return false
+	}
+
+	var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+	defer cancel()
+
+	user, err := auth.users.GetUser(ctx, claims.Uid)
+	if err != nil {
+		unauthorized(c, "invalid_token", "unknown user")
+		return false
+	}
+	if err = tokens.CheckRevoked(claims, &user); err != nil {
+		unauthorized(c, "invalid_token", err.Error())
+		return false
+	}
+
+	if err = auth.sessions.TouchSession(ctx, claims.Sid, claims.Uid, c.ClientIP()); err != nil {
+		unauthorized(c, "invalid_token", database.ErrSessionRevoked.Error())
+		return false
+	}
+
+	c.Set("email", claims.Email)
+	c.Set("uid", claims.Uid)
+	c.Set("sid", claims.Sid)
+	c.Set("role", claims.Role)
+	c.Set("two_factor", claims.TwoFactor)
+	withLogAttrs(c, "user_id", claims.Uid)
+	return true
+}
+
+const challenge = `Bearer realm="ecommerce"`
+
+func unauthorized(c *gin.Context, errorCode, description string) {
+	value := challenge
+	if errorCode != "" {
+		value += `, error="` + errorCode + `", error_description="` + description + `"`
+	}
+
+	c.Header("WWW-Authenticate", value)
+	c.JSON(http.StatusUnauthorized, errorBody(c, description))
+	c.Abort()
+}
+
+func forbidden(c *gin.Context, scope, description string) {
+	value := challenge + `, error="insufficient_scope"`
+	if scope != "" {
+		value += `, scope="` + scope + `"`
+	}
+
+	c.Header("WWW-Authenticate", value)
+	c.JSON(http.StatusForbidden, errorBody(c, description))
+	c.Abort()
+}
+
+// VerifiedEmail lets through only users who have confirmed their email
+// address; it must run after Authentication.
+func (auth *Auth) VerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 5*time.Second)
+		defer cancel()
+
+		user, err := auth.users.GetUser(ctx, c.GetString("uid"))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+			c.JSON(http.StatusUnauthorized, errorBody(c, err.Error()))
+			c.Abort()
+			return
+		}
+		if !user.EmailVerified {
+			c.JSON(http.StatusForbidden, errorBody(c, "email address is not verified"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RateLimit throttles requests per client IP.
+func RateLimit(limiter *ratelimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if wait, ok := limiter.Allow(c.ClientIP()); !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, errorBody(c, "too many requests"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func Currency(exchange *money.ExchangeRates) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		currency := c.Query("currency")
+		if currency == "" {
+			currency = c.Request.Header.Get("X-Currency")
+		}
+		if currency == "" {
+			currency = exchange.Base
+		}
+
+		currency = strings.ToUpper(currency)
+		if !exchange.Supports(currency) {
+			body := errorBody(c, "unsupported currency")
+			body["supported"] = exchange.Currencies()
+			c.JSON(http.StatusBadRequest, body)
 			c.Abort()
 			return
 		}
-		c.Set("email", claims.Email)
-		c.Set("uid", claims.Uid)
+
+		c.Set("currency", currency)
 		c.Next()
 	}
 }
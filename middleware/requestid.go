@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/logging"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds IDs taken from clients, as they end up in every
+// log line of the request.
+const maxRequestIDLength = 128
+
+// RequestID tags every request with an ID: the X-Request-ID header of the
+// client or proxy when it is usable, a random one otherwise. The ID is sent
+// back in X-Request-ID and in error responses. The request context carries
+// a logger with the ID, and the request is logged once it is answered.
+func RequestID(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.Request.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Header(RequestIDHeader, id)
+		c.Set("request_id", id)
+
+		requestLogger := logger.With("request_id", id)
+		if span := trace.SpanContextFromContext(c.Request.Context()); span.IsValid() {
+			requestLogger = requestLogger.With("trace_id", span.TraceID().String())
+		}
+		c.Request = c.Request.WithContext(logging.NewContext(c.Request.Context(), requestLogger))
+
+		c.Next()
+
+		status := c.Writer.Status()
+		attrs := []any{
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"route", c.FullPath(),
+			"status", status,
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"client_ip", c.ClientIP(),
+			"bytes", c.Writer.Size(),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, "errors", c.Errors.String())
+		}
+
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		// The logger is read again, as authentication adds the user to it.
+		logging.FromContext(c.Request.Context()).Log(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// Recovery answers 500 when a handler panics and logs the panic with the
+// request logger; it must run after RequestID.
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, recovered any) {
+		logging.FromContext(c.Request.Context()).Error("handler panicked",
+			"panic", recovered, "stack", string(debug.Stack()))
+		c.AbortWithStatusJSON(http.StatusInternalServerError, errorBody(c, "internal error"))
+	})
+}
+
+// withLogAttrs adds attributes to the logger of the request, so that every
+// later log line of the request carries them.
+func withLogAttrs(c *gin.Context, args ...any) {
+	ctx := c.Request.Context()
+	c.Request = c.Request.WithContext(logging.NewContext(ctx, logging.FromContext(ctx).With(args...)))
+}
+
+// errorBody is the JSON of an error response. Clients can quote the request
+// ID to find the logs of the request.
+func errorBody(c *gin.Context, message string) gin.H {
+	return gin.H{"error": message, "request_id": c.GetString("request_id")}
+}
+
+// validRequestID accepts printable ASCII only, so that IDs from clients
+// cannot forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+
+	return hex.EncodeToString(buf)
+}
@@ -1,61 +1,234 @@
 package models
 
 import (
+	"github.com/koinav/ecommerce/money"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"time"
 )
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type User struct {
-	ID             primitive.ObjectID `json:"_id" bson:"_id"`
-	FirstName      string             `json:"first_name" validate:"required,min=2,max=30"`
-	LastName       string             `json:"last_name" validate:"required,min=2,max=30"`
-	Password       string             `json:"password" validate:"required,min=6"`
-	Email          string             `json:"email" validate:"email,required"`
-	Phone          string             `json:"phone" validate:"required"`
-	Token          string             `json:"token"`
-	RefreshToken   string             `json:"refresh_token"`
-	CreatedAt      time.Time          `json:"created_at"`
-	UpdatedAt      time.Time          `json:"updated_at"`
-	UserID         string             `json:"user_id"`
-	UserCart       []ProductInCart    `json:"user_cart" bson:"user_cart"`
-	AddressDetails []Address          `json:"address" bson:"address"`
-	OrderStatus    []Order            `json:"orders" bson:"orders"`
+	ID                 primitive.ObjectID `json:"_id" bson:"_id"`
+	FirstName          string             `json:"first_name" validate:"required,min=2,max=30"`
+	LastName           string             `json:"last_name" validate:"required,min=2,max=30"`
+	Password           string             `json:"password" validate:"required,min=6,max=72"`
+	Email              string             `json:"email" bson:"email,omitempty" validate:"email,required"`
+	Phone              string             `json:"phone" bson:"phone,omitempty" validate:"required"`
+	Token              string             `json:"token"`
+	RefreshToken       string             `json:"refresh_token"`
+	CreatedAt          time.Time          `json:"created_at"`
+	UpdatedAt          time.Time          `json:"updated_at"`
+	UserID             string             `json:"user_id"`
+	Role               string             `json:"role" bson:"role"`
+	EmailVerified      bool               `json:"email_verified" bson:"email_verified"`
+	VerificationSentAt time.Time          `json:"-" bson:"verification_sent_at"`
+	TokensRevokedAt    time.Time          `json:"-" bson:"tokens_revoked_at"`
+	TwoFactorEnabled   bool               `json:"two_factor_enabled" bson:"two_factor_enabled"`
+	TOTPSecret         string             `json:"-" bson:"totp_secret"`
+	PendingTOTPSecret  string             `json:"-" bson:"totp_pending_secret"`
+	TOTPLastCounter    int64              `json:"-" bson:"totp_last_counter"`
+	RecoveryCodes      []string           `json:"-" bson:"recovery_codes"`
+	FailedLogins       int                `json:"-" bson:"failed_logins"`
+	LockedUntil        time.Time          `json:"-" bson:"locked_until"`
+	Identities         []ExternalIdentity `json:"-" bson:"identities,omitempty"`
+	UserCart           []ProductInCart    `json:"user_cart" bson:"user_cart"`
+	AddressDetails     []Address          `json:"address" bson:"address"`
+	OrderStatus        []Order            `json:"orders" bson:"orders"`
+}
+
+// ExternalIdentity links the user to an account at an OpenID Connect
+// provider, identified by the issuer and the subject it assigned.
+type ExternalIdentity struct {
+	Issuer   string    `bson:"issuer"`
+	Subject  string    `bson:"subject"`
+	Email    string    `bson:"email"`
+	LinkedAt time.Time `bson:"linked_at"`
+}
+
+// Profile is the part of User that is safe to send back to its owner.
+type Profile struct {
+	UserID        string    `json:"user_id"`
+	FirstName     string    `json:"first_name"`
+	LastName      string    `json:"last_name"`
+	Email         string    `json:"email"`
+	Phone         string    `json:"phone"`
+	EmailVerified bool      `json:"email_verified"`
+	TwoFactor     bool      `json:"two_factor_enabled"`
+	Role          string    `json:"role"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
 }
 
 type Product struct {
 	ProductID   primitive.ObjectID `bson:"_id"`
 	ProductName string             `json:"product_name"`
-	Price       uint64             `json:"price"`
+	Price       money.Money        `json:"price"`
 	Rating      uint8              `json:"rating"`
 	Image       string             `json:"image"`
+	Category    string             `json:"category" bson:"category"`
+	Weight      uint               `json:"weight" bson:"weight"`
+	Dimensions  Dimensions         `json:"dimensions" bson:"dimensions"`
+}
+
+type Dimensions struct {
+	Length uint `json:"length" bson:"length"`
+	Width  uint `json:"width" bson:"width"`
+	Height uint `json:"height" bson:"height"`
 }
 
 type ProductInCart struct {
 	ProductID   primitive.ObjectID `bson:"_id"`
 	ProductName string             `json:"product_name" bson:"product_name"`
-	Price       int                `json:"price" bson:"price"`
+	Price       money.Money        `json:"price" bson:"price"`
 	Rating      uint               `json:"rating" bson:"rating"`
 	Image       string             `json:"image" bson:"image"`
+	Category    string             `json:"category" bson:"category"`
+	Weight      uint               `json:"weight" bson:"weight"`
+	Dimensions  Dimensions         `json:"dimensions" bson:"dimensions"`
 }
 
+const (
+	AddressShipping = "shipping"
+	AddressBilling  = "billing"
+)
+
 type Address struct {
-	AddressID primitive.ObjectID `bson:"_id"`
-	House     string             `json:"house_name" bson:"house_name"`
-	Street    string             `json:"street_name" bson:"street_name"`
-	City      string             `json:"city_name" bson:"city_name"`
-	PostCode  string             `json:"post_code" bson:"post_code"`
+	AddressID       primitive.ObjectID `json:"address_id" bson:"_id"`
+	Label           string             `json:"label" bson:"label" validate:"max=40"`
+	House           string             `json:"house_name" bson:"house_name"`
+	Street          string             `json:"street_name" bson:"street_name"`
+	City            string             `json:"city_name" bson:"city_name"`
+	Region          string             `json:"region" bson:"region"`
+	PostCode        string             `json:"post_code" bson:"post_code"`
+	Country         string             `json:"country" bson:"country"`
+	DefaultShipping bool               `json:"default_shipping" bson:"default_shipping"`
+	DefaultBilling  bool               `json:"default_billing" bson:"default_billing"`
 }
 
 type Order struct {
-	OrderID       primitive.ObjectID `bson:"_id"`
-	OrderCart     []ProductInCart    `json:"order_list" bson:"order_list"`
-	OrderedAt     time.Time          `json:"ordered_at" bson:"ordered_at"`
-	Price         int                `json:"total_price" bson:"total_price"`
-	Discount      int                `json:"discount" bson:"discount"`
-	PaymentMethod Payment            `json:"payment_method" bson:"payment_method"`
+	OrderID         primitive.ObjectID `bson:"_id"`
+	OrderCart       []ProductInCart    `json:"order_list" bson:"order_list"`
+	OrderedAt       time.Time          `json:"ordered_at" bson:"ordered_at"`
+	Price           money.Money        `json:"total_price" bson:"total_price"`
+	Discount        money.Money        `json:"discount" bson:"discount"`
+	Tax             money.Money        `json:"tax" bson:"tax"`
+	TaxIncluded     bool               `json:"tax_included" bson:"tax_included"`
+	TaxLines        []TaxLine          `json:"tax_lines" bson:"tax_lines"`
+	ShippingMethod  string             `json:"shipping_method" bson:"shipping_method"`
+	ShippingCost    money.Money        `json:"shipping_cost" bson:"shipping_cost"`
+	ShippingAddress *Address           `json:"shipping_address" bson:"shipping_address"`
+	BillingAddress  *Address           `json:"billing_address" bson:"billing_address"`
+	PaymentMethod   Payment            `json:"payment_method" bson:"payment_method"`
+}
+
+type TaxLine struct {
+	Name     string      `json:"name" bson:"name"`
+	Category string      `json:"category" bson:"category"`
+	Rate     float64     `json:"rate" bson:"rate"`
+	Taxable  money.Money `json:"taxable" bson:"taxable"`
+	Amount   money.Money `json:"amount" bson:"amount"`
 }
 
 type Payment struct {
 	Digital bool
 	COD     bool
 }
+
+const (
+	ShipmentLabelCreated   = "label_created"
+	ShipmentInTransit      = "in_transit"
+	ShipmentOutForDelivery = "out_for_delivery"
+	ShipmentDelivered      = "delivered"
+	ShipmentException      = "exception"
+)
+
+type Shipment struct {
+	ShipmentID     primitive.ObjectID `json:"shipment_id" bson:"_id"`
+	OrderID        primitive.ObjectID `json:"order_id" bson:"order_id" validate:"required"`
+	UserID         string             `json:"user_id" bson:"user_id"`
+	Carrier        string             `json:"carrier" bson:"carrier" validate:"required"`
+	TrackingNumber string             `json:"tracking_number" bson:"tracking_number" validate:"required"`
+	Items          []ShipmentItem     `json:"items" bson:"items" validate:"required,min=1,dive"`
+	Status         string             `json:"status" bson:"status"`
+	Events         []TrackingEvent    `json:"events" bson:"events"`
+	CreatedAt      time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt      time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+type ShipmentItem struct {
+	ProductID primitive.ObjectID `json:"product_id" bson:"product_id" validate:"required"`
+	Quantity  int                `json:"quantity" bson:"quantity" validate:"min=1"`
+}
+
+type TrackingEvent struct {
+	Status      string    `json:"status" bson:"status" validate:"required,oneof=label_created in_transit out_for_delivery delivered exception"`
+	Location    string    `json:"location" bson:"location"`
+	Description string    `json:"description" bson:"description"`
+	OccurredAt  time.Time `json:"occurred_at" bson:"occurred_at"`
+}
+
+// Session is a login on one device; every token pair belongs to a session.
+type Session struct {
+	SessionID  primitive.ObjectID `json:"session_id" bson:"_id"`
+	UserID     string             `json:"-" bson:"user_id"`
+	UserAgent  string             `json:"user_agent" bson:"user_agent"`
+	IP         string             `json:"ip" bson:"ip"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+	LastSeenAt time.Time          `json:"last_seen_at" bson:"last_seen_at"`
+	ExpiresAt  time.Time          `json:"expires_at" bson:"expires_at"`
+	RevokedAt  *time.Time         `json:"-" bson:"revoked_at"`
+	Current    bool               `json:"current" bson:"-"`
+}
+
+// Scopes an API key may be granted.
+const (
+	ScopeProductsWrite  = "products:write"
+	ScopeShipmentsWrite = "shipments:write"
+)
+
+// APIKey lets a machine client call the admin endpoints its scopes allow.
+// Only the hash of the key is stored.
+type APIKey struct {
+	KeyID      primitive.ObjectID `json:"key_id" bson:"_id"`
+	Name       string             `json:"name" bson:"name"`
+	Prefix     string             `json:"prefix" bson:"prefix"`
+	KeyHash    string             `json:"-" bson:"key_hash"`
+	Scopes     []string           `json:"scopes" bson:"scopes"`
+	CreatedBy  string             `json:"created_by" bson:"created_by"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+	ExpiresAt  *time.Time         `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	LastUsedAt *time.Time         `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+	RevokedAt  *time.Time         `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+func (key *APIKey) HasScope(scope string) bool {
+	for _, granted := range key.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+const (
+	PurposePasswordReset     = "password_reset"
+	PurposeEmailVerification = "email_verification"
+	PurposeAccountUnlock     = "account_unlock"
+)
+
+type OneTimeToken struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	UserID    string             `bson:"user_id"`
+	Purpose   string             `bson:"purpose"`
+	TokenHash string             `bson:"token_hash"`
+	// Email is the address the link was sent to.
+	Email     string     `bson:"email,omitempty"`
+	CreatedAt time.Time  `bson:"created_at"`
+	ExpiresAt time.Time  `bson:"expires_at"`
+	UsedAt    *time.Time `bson:"used_at"`
+}
@@ -0,0 +1,169 @@
+package money
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+var (
+	ErrOverflow     = errors.New("amount is out of range")
+	ErrInvalidRatio = errors.New("invalid ratio")
+)
+
+type RoundingMode int
+
+const (
+	// HalfUp rounds halves away from zero, the commercial rounding used for
+	// tax amounts on receipts.
+	HalfUp RoundingMode = iota
+	// HalfEven rounds halves to the nearest even minor unit, which does not
+	// drift when many converted amounts are summed.
+	HalfEven
+)
+
+func (m Money) Add(other Money) (Money, error) {
+	currency, err := commonCurrency(m, other)
+	if err != nil {
+		return Money{}, err
+	}
+
+	sum := m.Amount + other.Amount
+	if (other.Amount > 0 && sum < m.Amount) || (other.Amount < 0 && sum > m.Amount) {
+		return Money{}, ErrOverflow
+	}
+
+	return New(sum, currency), nil
+}
+
+func (m Money) Sub(other Money) (Money, error) {
+	if other.Amount == math.MinInt64 {
+		return Money{}, ErrOverflow
+	}
+
+	return m.Add(Money{Amount: -other.Amount, Currency: other.Currency})
+}
+
+func (m Money) Mul(n int64) (Money, error) {
+	if m.Amount == 0 || n == 0 {
+		return New(0, m.Currency), nil
+	}
+
+	product := m.Amount * n
+	if product/n != m.Amount || (m.Amount == -1 && n == math.MinInt64) || (n == -1 && m.Amount == math.MinInt64) {
+		return Money{}, ErrOverflow
+	}
+
+	return New(product, m.Currency), nil
+}
+
+// MulRat multiplies the amount by an exact ratio and rounds the result to a
+// whole minor unit with mode.
+func (m Money) MulRat(ratio *big.Rat, mode RoundingMode) (Money, error) {
+	if ratio == nil {
+		return Money{}, ErrInvalidRatio
+	}
+
+	value := new(big.Rat).Mul(new(big.Rat).SetInt64(m.Amount), ratio)
+	amount, err := round(value, mode)
+	if err != nil {
+		return Money{}, err
+	}
+
+	return New(amount, m.Currency), nil
+}
+
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+func (m Money) Cmp(other Money) (int, error) {
+	if _, err := commonCurrency(m, other); err != nil {
+		return 0, err
+	}
+
+	switch {
+	case m.Amount < other.Amount:
+		return -1, nil
+	case m.Amount > other.Amount:
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+func Sum(currency string, amounts ...Money) (Money, error) {
+	total := Zero(currency)
+	for _, amount := range amounts {
+		var err error
+		if total, err = total.Add(amount); err != nil {
+			return Money{}, err
+		}
+	}
+
+	return total, nil
+}
+
+// Ratio turns a decimal rate such as 0.2 into an exact ratio, so that it is
+// not multiplied with the binary floating point error of the float.
+func Ratio(rate float64) (*big.Rat, error) {
+	if math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return nil, ErrInvalidRatio
+	}
+
+	ratio, ok := new(big.Rat).SetString(strconv.FormatFloat(rate, 'f', -1, 64))
+	if !ok {
+		return nil, ErrInvalidRatio
+	}
+
+	return ratio, nil
+}
+
+// commonCurrency lets a zero without a currency stand for zero in any
+// currency; any other amount without one is not comparable.
+func commonCurrency(a, b Money) (string, error) {
+	switch {
+	case a.Currency == b.Currency:
+		return a.Currency, nil
+	case a.Currency == "" && a.Amount == 0:
+		return b.Currency, nil
+	case b.Currency == "" && b.Amount == 0:
+		return a.Currency, nil
+	}
+
+	return "", ErrCurrencyMismatch
+}
+
+func round(value *big.Rat, mode RoundingMode) (int64, error) {
+	num := value.Num()
+	denom := value.Denom()
+
+	quotient, remainder := new(big.Int).QuoRem(num, denom, new(big.Int))
+	if remainder.Sign() != 0 {
+		twice := new(big.Int).Abs(remainder)
+		twice.Lsh(twice, 1)
+
+		away := false
+		switch twice.Cmp(denom) {
+		case 1:
+			away = true
+		case 0:
+			away = mode == HalfUp || quotient.Bit(0) == 1
+		}
+
+		if away {
+			quotient.Add(quotient, big.NewInt(int64(value.Sign())))
+		}
+	}
+
+	if !quotient.IsInt64() {
+		return 0, ErrOverflow
+	}
+
+	return quotient.Int64(), nil
+}
+
+func pow10(exp int) *big.Rat {
+	return new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))
+}
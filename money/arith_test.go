@@ -0,0 +1,180 @@
+package money
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    Money
+		want    Money
+		wantErr error
+	}{
+		{"same currency", New(100, "RUB"), New(50, "RUB"), New(150, "RUB"), nil},
+		{"negative", New(100, "RUB"), New(-150, "RUB"), New(-50, "RUB"), nil},
+		{"zero without currency", Money{}, New(5, "RUB"), New(5, "RUB"), nil},
+		{"to zero without currency", New(5, "RUB"), Money{}, New(5, "RUB"), nil},
+		{"amount without currency", Money{Amount: 5}, New(5, "RUB"), Money{}, ErrCurrencyMismatch},
+		{"to amount without currency", New(5, "RUB"), Money{Amount: 5}, Money{}, ErrCurrencyMismatch},
+		{"other currency", New(5, "RUB"), New(5, "USD"), Money{}, ErrCurrencyMismatch},
+		{"overflow", New(math.MaxInt64, "RUB"), New(1, "RUB"), Money{}, ErrOverflow},
+		{"negative overflow", New(math.MinInt64, "RUB"), New(-1, "RUB"), Money{}, ErrOverflow},
+		{"largest", New(math.MaxInt64-1, "RUB"), New(1, "RUB"), New(math.MaxInt64, "RUB"), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.a.Add(tt.b)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("%v + %v = %v, %v; want %v, %v", tt.a, tt.b, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSub(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    Money
+		want    Money
+		wantErr error
+	}{
+		{"same currency", New(100, "RUB"), New(30, "RUB"), New(70, "RUB"), nil},
+		{"smallest", New(0, "RUB"), New(math.MinInt64, "RUB"), Money{}, ErrOverflow},
+		{"overflow", New(math.MinInt64, "RUB"), New(1, "RUB"), Money{}, ErrOverflow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.a.Sub(tt.b)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("%v - %v = %v, %v; want %v, %v", tt.a, tt.b, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMul(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       Money
+		n       int64
+		want    Money
+		wantErr error
+	}{
+		{"times three", New(150, "RUB"), 3, New(450, "RUB"), nil},
+		{"by zero", New(math.MaxInt64, "RUB"), 0, New(0, "RUB"), nil},
+		{"negative", New(150, "RUB"), -2, New(-300, "RUB"), nil},
+		{"overflow", New(math.MaxInt64, "RUB"), 2, Money{}, ErrOverflow},
+		{"negative overflow", New(math.MinInt64/2-1, "RUB"), 2, Money{}, ErrOverflow},
+		{"smallest by minus one", New(math.MinInt64, "RUB"), -1, Money{}, ErrOverflow},
+		{"minus one by smallest", New(-1, "RUB"), math.MinInt64, Money{}, ErrOverflow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.m.Mul(tt.n)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("%v * %d = %v, %v; want %v, %v", tt.m, tt.n, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMulRat(t *testing.T) {
+	tenth := big.NewRat(1, 10)
+	tests := []struct {
+		name     string
+		m        Money
+		ratio    *big.Rat
+		halfUp   int64
+		halfEven int64
+		wantErr  error
+	}{
+		{"exact", New(250, "RUB"), tenth, 25, 25, nil},
+		{"half to even down", New(25, "RUB"), tenth, 3, 2, nil},
+		{"half to even up", New(35, "RUB"), tenth, 4, 4, nil},
+		{"negative half", New(-25, "RUB"), tenth, -3, -2, nil},
+		{"below half", New(24, "RUB"), tenth, 2, 2, nil},
+		{"above half", New(26, "RUB"), tenth, 3, 3, nil},
+		{"overflow", New(math.MaxInt64, "RUB"), big.NewRat(3, 2), 0, 0, ErrOverflow},
+		{"no ratio", New(100, "RUB"), nil, 0, 0, ErrInvalidRatio},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for mode, want := range map[RoundingMode]int64{HalfUp: tt.halfUp, HalfEven: tt.halfEven} {
+				got, err := tt.m.MulRat(tt.ratio, mode)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("mode %d: error %v, want %v", mode, err, tt.wantErr)
+				}
+				if err == nil && got != New(want, "RUB") {
+					t.Errorf("mode %d: %v * %v = %v, want %d", mode, tt.m, tt.ratio, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		value    *big.Rat
+		halfUp   int64
+		halfEven int64
+	}{
+		{big.NewRat(5, 2), 3, 2},
+		{big.NewRat(7, 2), 4, 4},
+		{big.NewRat(-5, 2), -3, -2},
+		{big.NewRat(-7, 2), -4, -4},
+		{big.NewRat(1, 2), 1, 0},
+		{big.NewRat(-1, 2), -1, 0},
+		{big.NewRat(4, 3), 1, 1},
+		{big.NewRat(5, 3), 2, 2},
+		{big.NewRat(-5, 3), -2, -2},
+		{big.NewRat(7, 1), 7, 7},
+	}
+
+	for _, tt := range tests {
+		if got, err := round(tt.value, HalfUp); err != nil || got != tt.halfUp {
+			t.Errorf("round(%v, HalfUp) = %d, %v; want %d", tt.value, got, err, tt.halfUp)
+		}
+		if got, err := round(tt.value, HalfEven); err != nil || got != tt.halfEven {
+			t.Errorf("round(%v, HalfEven) = %d, %v; want %d", tt.value, got, err, tt.halfEven)
+		}
+	}
+
+	tooLarge := new(big.Rat).SetFrac(new(big.Int).Lsh(big.NewInt(1), 64), big.NewInt(1))
+	if _, err := round(tooLarge, HalfUp); !errors.Is(err, ErrOverflow) {
+		t.Errorf("round(2^64) error = %v, want %v", err, ErrOverflow)
+	}
+}
+
+func TestFromMajor(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		mode     RoundingMode
+		want     Money
+		wantErr  error
+	}{
+		{19.99, "RUB", HalfUp, New(1999, "RUB"), nil},
+		{0.1 + 0.2, "RUB", HalfUp, New(30, "RUB"), nil},
+		{0.125, "usd", HalfUp, New(13, "USD"), nil},
+		{0.125, "USD", HalfEven, New(12, "USD"), nil},
+		{150.5, "JPY", HalfEven, New(150, "JPY"), nil},
+		{1, "XXX", HalfUp, Money{}, ErrUnknownCurrency},
+		{math.Inf(1), "RUB", HalfUp, Money{}, ErrInvalidRatio},
+	}
+
+	for _, tt := range tests {
+		got, err := FromMajor(tt.amount, tt.currency, tt.mode)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("FromMajor(%v, %s, %d) = %v, %v; want %v, %v",
+				tt.amount, tt.currency, tt.mode, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package money
+
+import (
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"math/big"
+	"reflect"
+)
+
+// Legacy reads the amounts sent and stored before amounts carried a
+// currency, when they were plain numbers in major units of the shop
+// currency. Rounding applies to fractions of a minor unit.
+type Legacy struct {
+	Currency string
+	Rounding RoundingMode
+}
+
+// ParseJSON accepts both the {"amount", "currency"} object and a bare number
+// in major units of the legacy currency, which is what clients sent before.
+func (legacy Legacy) ParseJSON(data []byte) (Money, error) {
+	var major json.Number
+	if err := json.Unmarshal(data, &major); err == nil {
+		amount, ok := new(big.Rat).SetString(major.String())
+		if !ok {
+			return Money{}, ErrInvalidRatio
+		}
+
+		return fromMajorRat(amount, legacy.Currency, legacy.Rounding)
+	}
+
+	var m Money
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Money{}, err
+	}
+
+	return m, nil
+}
+
+// Registry is the default BSON registry with Money decoded by legacy, so that
+// numeric prices stored before are read in the legacy currency.
+func (legacy Legacy) Registry() *bsoncodec.Registry {
+	registry := bson.NewRegistry()
+	registry.RegisterTypeDecoder(reflect.TypeOf(Money{}), legacy)
+
+	return registry
+}
+
+// DecodeValue implements bsoncodec.ValueDecoder for Money.
+func (legacy Legacy) DecodeValue(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	t, data, err := bsonrw.Copier{}.CopyValueToBytes(vr)
+	if err != nil {
+		return err
+	}
+
+	m, err := legacy.fromBSON(t, data)
+	if err != nil {
+		return err
+	}
+
+	val.Set(reflect.ValueOf(m))
+	return nil
+}
+
+func (legacy Legacy) fromBSON(t bsontype.Type, data []byte) (Money, error) {
+	switch t {
+	case bsontype.Int32, bsontype.Int64, bsontype.Double:
+		var number interface{}
+		if err := bson.UnmarshalValue(t, data, &number); err != nil {
+			return Money{}, err
+		}
+
+		major := new(big.Rat)
+		switch v := number.(type) {
+		case int32:
+			major.SetInt64(int64(v))
+		case int64:
+			major.SetInt64(v)
+		case float64:
+			ratio, err := Ratio(v)
+			if err != nil {
+				return Money{}, err
+			}
+			major = ratio
+		}
+
+		return fromMajorRat(major, legacy.Currency, legacy.Rounding)
+	case bsontype.Null, bsontype.Undefined:
+		return Money{}, nil
+	}
+
+	type plain Money
+	var value plain
+	if err := bson.UnmarshalValue(t, data, &value); err != nil {
+		return Money{}, err
+	}
+
+	return Money(value), nil
+}
@@ -0,0 +1,114 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+var (
+	ErrUnknownCurrency  = errors.New("unknown currency")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	ErrMajorUnits       = errors.New("amount must be an object with amount in minor units and currency")
+)
+
+// exponents holds the number of minor units digits of each supported ISO 4217
+// currency.
+var exponents = map[string]int{
+	"RUB": 2,
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"CNY": 2,
+	"KZT": 2,
+	"BYN": 2,
+	"JPY": 0,
+}
+
+type Money struct {
+	Amount   int64  `json:"amount" bson:"amount"`
+	Currency string `json:"currency" bson:"currency"`
+}
+
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: strings.ToUpper(currency)}
+}
+
+func Zero(currency string) Money {
+	return New(0, currency)
+}
+
+func Supported(currency string) bool {
+	_, ok := exponents[strings.ToUpper(currency)]
+	return ok
+}
+
+func Exponent(currency string) (int, error) {
+	exp, ok := exponents[strings.ToUpper(currency)]
+	if !ok {
+		return 0, ErrUnknownCurrency
+	}
+
+	return exp, nil
+}
+
+// FromMajor converts an amount in major units (roubles, dollars) into minor
+// units of the currency, rounding fractions of a minor unit with mode.
+func FromMajor(amount float64, currency string, mode RoundingMode) (Money, error) {
+	ratio, err := Ratio(amount)
+	if err != nil {
+		return Money{}, err
+	}
+
+	return fromMajorRat(ratio, currency, mode)
+}
+
+func fromMajorRat(amount *big.Rat, currency string, mode RoundingMode) (Money, error) {
+	exp, err := Exponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+
+	minor, err := round(new(big.Rat).Mul(amount, pow10(exp)), mode)
+	if err != nil {
+		return Money{}, err
+	}
+
+	return New(minor, currency), nil
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) String() string {
+	exp, err := Exponent(m.Currency)
+	if err != nil || exp == 0 {
+		return fmt.Sprintf("%d %s", m.Amount, m.Currency)
+	}
+
+	return new(big.Rat).Quo(new(big.Rat).SetInt64(m.Amount), pow10(exp)).FloatString(exp) + " " + m.Currency
+}
+
+// UnmarshalJSON accepts the {"amount", "currency"} object. Bare numbers in
+// major units are read by Legacy.ParseJSON, which knows their currency.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var major json.Number
+	if err := json.Unmarshal(data, &major); err == nil {
+		return ErrMajorUnits
+	}
+
+	type plain Money
+	var value plain
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	if !Supported(value.Currency) {
+		return ErrUnknownCurrency
+	}
+
+	*m = New(value.Amount, value.Currency)
+	return nil
+}
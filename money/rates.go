@@ -0,0 +1,125 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"strings"
+)
+
+var ErrCantLoadRates = errors.New("cannot load exchange rates")
+
+// ExchangeRates converts between currencies through a base currency: Rates
+// holds how many units of a currency one unit of Base buys. Converted amounts
+// are rounded to whole minor units with Rounding.
+type ExchangeRates struct {
+	Base     string             `json:"base"`
+	Rates    map[string]float64 `json:"rates"`
+	Rounding RoundingMode       `json:"-"`
+}
+
+func NewExchangeRates(base string, rounding RoundingMode) *ExchangeRates {
+	return &ExchangeRates{Base: strings.ToUpper(base), Rates: map[string]float64{}, Rounding: rounding}
+}
+
+// LoadExchangeRates reads rates from a JSON file. Rates of unsupported
+// currencies are skipped with a warning to logger.
+func LoadExchangeRates(path string, rounding RoundingMode, logger *slog.Logger) (*ExchangeRates, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCantLoadRates, err)
+	}
+
+	var rates ExchangeRates
+	if err = json.Unmarshal(data, &rates); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCantLoadRates, err)
+	}
+
+	rates.Base = strings.ToUpper(rates.Base)
+	rates.Rounding = rounding
+	if !Supported(rates.Base) {
+		return nil, ErrUnknownCurrency
+	}
+
+	normalized := make(map[string]float64, len(rates.Rates))
+	for currency, rate := range rates.Rates {
+		currency = strings.ToUpper(currency)
+		if !Supported(currency) || rate <= 0 {
+			logger.Warn("skipping exchange rate", "currency", currency)
+			continue
+		}
+		normalized[currency] = rate
+	}
+	rates.Rates = normalized
+
+	return &rates, nil
+}
+
+func (rates *ExchangeRates) Supports(currency string) bool {
+	_, ok := rates.rate(currency)
+	return ok
+}
+
+func (rates *ExchangeRates) Currencies() []string {
+	currencies := []string{rates.Base}
+	for currency := range rates.Rates {
+		if currency != rates.Base {
+			currencies = append(currencies, currency)
+		}
+	}
+
+	return currencies
+}
+
+func (rates *ExchangeRates) Convert(m Money, to string) (Money, error) {
+	to = strings.ToUpper(to)
+	if m.Currency == to {
+		return m, nil
+	}
+
+	fromRate, ok := rates.rate(m.Currency)
+	if !ok {
+		return Money{}, ErrUnknownCurrency
+	}
+	toRate, ok := rates.rate(to)
+	if !ok {
+		return Money{}, ErrUnknownCurrency
+	}
+
+	fromExp, _ := Exponent(m.Currency)
+	toExp, _ := Exponent(to)
+
+	fromRatio, err := Ratio(fromRate)
+	if err != nil {
+		return Money{}, err
+	}
+	toRatio, err := Ratio(toRate)
+	if err != nil {
+		return Money{}, err
+	}
+
+	ratio := new(big.Rat).Quo(toRatio, fromRatio)
+	ratio.Mul(ratio, pow10(toExp))
+	ratio.Quo(ratio, pow10(fromExp))
+
+	converted, err := m.MulRat(ratio, rates.Rounding)
+	if err != nil {
+		return Money{}, err
+	}
+	converted.Currency = to
+
+	return converted, nil
+}
+
+func (rates *ExchangeRates) rate(currency string) (float64, bool) {
+	currency = strings.ToUpper(currency)
+	if currency == rates.Base {
+		return 1, true
+	}
+
+	rate, ok := rates.Rates[currency]
+	return rate, ok
+}
@@ -0,0 +1,43 @@
+package money
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	rates := &ExchangeRates{Base: "RUB", Rates: map[string]float64{"USD": 0.01, "JPY": 1.5}}
+
+	tests := []struct {
+		name     string
+		m        Money
+		to       string
+		halfUp   Money
+		halfEven Money
+		wantErr  error
+	}{
+		{"same currency", New(12345, "RUB"), "rub", New(12345, "RUB"), New(12345, "RUB"), nil},
+		{"from base", New(10000, "RUB"), "USD", New(100, "USD"), New(100, "USD"), nil},
+		{"to base", New(1, "USD"), "RUB", New(100, "RUB"), New(100, "RUB"), nil},
+		{"between others", New(100, "USD"), "JPY", New(150, "JPY"), New(150, "JPY"), nil},
+		{"half to even down", New(50, "RUB"), "USD", New(1, "USD"), New(0, "USD"), nil},
+		{"half to even up", New(150, "RUB"), "USD", New(2, "USD"), New(2, "USD"), nil},
+		{"no minor units", New(300, "RUB"), "JPY", New(5, "JPY"), New(4, "JPY"), nil},
+		{"negative half", New(-50, "RUB"), "USD", New(-1, "USD"), New(0, "USD"), nil},
+		{"unknown source", New(100, "EUR"), "USD", Money{}, Money{}, ErrUnknownCurrency},
+		{"unknown target", New(100, "RUB"), "EUR", Money{}, Money{}, ErrUnknownCurrency},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for mode, want := range map[RoundingMode]Money{HalfUp: tt.halfUp, HalfEven: tt.halfEven} {
+				rates.Rounding = mode
+				got, err := rates.Convert(tt.m, tt.to)
+				if !errors.Is(err, tt.wantErr) || got != want {
+					t.Errorf("mode %d: Convert(%v, %s) = %v, %v; want %v, %v",
+						mode, tt.m, tt.to, got, err, want, tt.wantErr)
+				}
+			}
+		})
+	}
+}
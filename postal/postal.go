@@ -0,0 +1,214 @@
+package postal
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/koinav/ecommerce/models"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//go:embed countries.json
+var countriesData []byte
+
+const maxFieldLength = 100
+
+type Country struct {
+	Name            string   `json:"name"`
+	PostCode        string   `json:"post_code"`
+	PostCodeExample string   `json:"post_code_example"`
+	Required        []string `json:"required"`
+	Regions         []string `json:"regions"`
+
+	postCode *regexp.Regexp
+}
+
+// FieldErrors maps the JSON name of every invalid address field to the reason.
+type FieldErrors map[string]string
+
+func (errs FieldErrors) Error() string {
+	fields := make([]string, 0, len(errs))
+	for field := range errs {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	messages := make([]string, 0, len(fields))
+	for _, field := range fields {
+		messages = append(messages, field+": "+errs[field])
+	}
+
+	return "invalid address: " + strings.Join(messages, "; ")
+}
+
+type Validator struct {
+	countries      map[string]*Country
+	defaultCountry string
+}
+
+func NewValidator(defaultCountry string) (*Validator, error) {
+	countries := make(map[string]*Country)
+	if err := json.Unmarshal(countriesData, &countries); err != nil {
+		return nil, err
+	}
+
+	for code, country := range countries {
+		if country.PostCode == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(country.PostCode)
+		if err != nil {
+			return nil, fmt.Errorf("post code format of %s: %w", code, err)
+		}
+		country.postCode = pattern
+	}
+
+	defaultCountry = strings.ToUpper(defaultCountry)
+	if _, ok := countries[defaultCountry]; !ok {
+		return nil, fmt.Errorf("unsupported default country %q", defaultCountry)
+	}
+
+	return &Validator{countries: countries, defaultCountry: defaultCountry}, nil
+}
+
+func (v *Validator) Country(code string) (*Country, bool) {
+	country, ok := v.countries[strings.ToUpper(code)]
+	return country, ok
+}
+
+// Normalize tidies user input before it is validated and stored: surrounding
+// and repeated whitespace is dropped, codes are upper-cased, names typed in a
+// single case are title-cased and post codes are brought to the national
+// layout when only the separator is off.
+func (v *Validator) Normalize(address *models.Address) {
+	address.Label = collapseSpaces(address.Label)
+	address.House = collapseSpaces(address.House)
+	address.Street = titleIfSingleCase(collapseSpaces(address.Street))
+	address.City = titleIfSingleCase(collapseSpaces(address.City))
+	address.Region = collapseSpaces(address.Region)
+	address.PostCode = strings.ToUpper(collapseSpaces(address.PostCode))
+
+	address.Country = strings.ToUpper(strings.TrimSpace(address.Country))
+	if address.Country == "" {
+		address.Country = v.defaultCountry
+	}
+
+	country, ok := v.countries[address.Country]
+	if !ok {
+		return
+	}
+
+	if len(country.Regions) > 0 {
+		address.Region = strings.ToUpper(address.Region)
+	} else {
+		address.Region = titleIfSingleCase(address.Region)
+	}
+
+	if country.postCode != nil && !country.postCode.MatchString(address.PostCode) {
+		if reformatted := reformatPostCode(address.PostCode, country.PostCodeExample); country.postCode.MatchString(reformatted) {
+			address.PostCode = reformatted
+		}
+	}
+}
+
+func (v *Validator) Validate(address *models.Address) error {
+	errs := make(FieldErrors)
+
+	country, ok := v.countries[address.Country]
+	if !ok {
+		errs["country"] = "unsupported country"
+		return errs
+	}
+
+	fields := map[string]string{
+		"label":       address.Label,
+		"house_name":  address.House,
+		"street_name": address.Street,
+		"city_name":   address.City,
+		"region":      address.Region,
+		"post_code":   address.PostCode,
+	}
+	for name, value := range fields {
+		if utf8.RuneCountInString(value) > maxFieldLength {
+			errs[name] = fmt.Sprintf("must be at most %d characters", maxFieldLength)
+		}
+	}
+
+	for _, name := range country.Required {
+		if fields[name] == "" {
+			errs[name] = "is required in " + country.Name
+		}
+	}
+
+	if _, failed := errs["post_code"]; !failed && address.PostCode != "" && country.postCode != nil &&
+		!country.postCode.MatchString(address.PostCode) {
+		errs["post_code"] = "does not match the format of " + country.Name + ", e.g. " + country.PostCodeExample
+	}
+
+	if _, failed := errs["region"]; !failed && address.Region != "" && len(country.Regions) > 0 &&
+		!contains(country.Regions, address.Region) {
+		errs["region"] = "is not a region of " + country.Name
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func collapseSpaces(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+func titleIfSingleCase(value string) string {
+	hasUpper, hasLower := false, false
+	for _, r := range value {
+		hasUpper = hasUpper || unicode.IsUpper(r)
+		hasLower = hasLower || unicode.IsLower(r)
+	}
+	if hasUpper && hasLower {
+		return value
+	}
+
+	words := strings.Fields(value)
+	for i, word := range words {
+		runes := []rune(strings.ToLower(word))
+		runes[0] = unicode.ToUpper(runes[0])
+		words[i] = string(runes)
+	}
+
+	return strings.Join(words, " ")
+}
+
+// reformatPostCode strips separators from postCode and puts back the one the
+// national example has, at the same distance from the end.
+func reformatPostCode(postCode, example string) string {
+	compact := strings.NewReplacer(" ", "", "-", "").Replace(postCode)
+
+	separator := strings.IndexAny(example, " -")
+	if separator < 0 {
+		return compact
+	}
+
+	tail := len(example) - separator - 1
+	if len(compact) <= tail {
+		return compact
+	}
+
+	return compact[:len(compact)-tail] + example[separator:separator+1] + compact[len(compact)-tail:]
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Policy says how long to block after repeated failures: nothing until
+// Threshold failures, then Base doubling with every further failure, up to Max.
+type Policy struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+}
+
+func (policy Policy) Delay(failures int) time.Duration {
+	if policy.Threshold <= 0 || failures < policy.Threshold {
+		return 0
+	}
+
+	delay := policy.Base
+	for i := policy.Threshold; i < failures && delay < policy.Max; i++ {
+		delay *= 2
+	}
+	if delay > policy.Max {
+		delay = policy.Max
+	}
+
+	return delay
+}
+
+// Backoff counts failures per key and blocks the key according to Policy.
+// Failures are forgotten once a key has been quiet for Policy.Max.
+type Backoff struct {
+	mu        sync.Mutex
+	policy    Policy
+	entries   map[string]*failures
+	lastSweep time.Time
+}
+
+type failures struct {
+	count        int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+func NewBackoff(policy Policy) *Backoff {
+	return &Backoff{
+		policy:    policy,
+		entries:   make(map[string]*failures),
+		lastSweep: time.Now(),
+	}
+}
+
+// Blocked reports whether key is blocked and for how long.
+func (backoff *Backoff) Blocked(key string) (time.Duration, bool) {
+	backoff.mu.Lock()
+	defer backoff.mu.Unlock()
+
+	entry, ok := backoff.entries[key]
+	if !ok {
+		return 0, false
+	}
+
+	wait := time.Until(entry.blockedUntil)
+	return wait, wait > 0
+}
+
+func (backoff *Backoff) Fail(key string) {
+	backoff.mu.Lock()
+	defer backoff.mu.Unlock()
+
+	now := time.Now()
+	backoff.sweep(now)
+
+	entry, ok := backoff.entries[key]
+	if !ok || backoff.expired(entry, now) {
+		entry = &failures{}
+		backoff.entries[key] = entry
+	}
+
+	entry.count++
+	entry.last = now
+	if delay := backoff.policy.Delay(entry.count); delay > 0 {
+		entry.blockedUntil = now.Add(delay)
+	}
+}
+
+func (backoff *Backoff) Reset(key string) {
+	backoff.mu.Lock()
+	defer backoff.mu.Unlock()
+
+	delete(backoff.entries, key)
+}
+
+func (backoff *Backoff) expired(entry *failures, now time.Time) bool {
+	return now.Sub(entry.last) > backoff.policy.Max && now.After(entry.blockedUntil)
+}
+
+func (backoff *Backoff) sweep(now time.Time) {
+	if now.Sub(backoff.lastSweep) < sweepInterval {
+		return
+	}
+	backoff.lastSweep = now
+
+	for key, entry := range backoff.entries {
+		if backoff.expired(entry, now) {
+			delete(backoff.entries, key)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Package ratelimit keeps in-memory, per-key counters for throttling clients.
+// The state is local to the process, so with several replicas each of them
+// enforces its own limits.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const sweepInterval = time.Minute
+
+// Limiter is a token bucket per key: every key may spend burst requests at
+// once, and gets perMinute requests back each minute.
+type Limiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(perMinute, burst int) *Limiter {
+	return &Limiter{
+		rate:      float64(perMinute) / 60,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow spends a request of key. When none is left it reports how long to
+// wait for the next one.
+func (limiter *Limiter) Allow(key string) (time.Duration, bool) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	limiter.sweep(now)
+
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limiter.burst, last: now}
+		limiter.buckets[key] = b
+	}
+
+	b.tokens = math.Min(limiter.burst, b.tokens+now.Sub(b.last).Seconds()*limiter.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / limiter.rate * float64(time.Second))
+		return wait, false
+	}
+
+	b.tokens--
+	return 0, true
+}
+
+// sweep forgets buckets that have refilled completely, they are the same as
+// missing ones.
+func (limiter *Limiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < sweepInterval {
+		return
+	}
+	limiter.lastSweep = now
+
+	full := time.Duration(limiter.burst / limiter.rate * float64(time.Second))
+	for key, b := range limiter.buckets {
+		if now.Sub(b.last) >= full {
+			delete(limiter.buckets, key)
+		}
+	}
+}
@@ -5,10 +5,18 @@ import (
 	"github.com/koinav/ecommerce/controllers"
 )
 
-func UserRoutes(incoming *gin.Engine) {
-	incoming.POST("/users/signup", controllers.SignUp())
-	incoming.POST("/users/login", controllers.LogIn())
-	incoming.GET("/users/productview", controllers.ViewProducts())
-	incoming.GET("/users/search", controllers.SearchProductByQuery())
-	incoming.POST("/admin/addproduct", controllers.ProductViewerAdmin())
+// UserRoutes registers the public routes; authLimit guards the account
+// endpoints and searchLimit the catalogue.
+func UserRoutes(incoming *gin.Engine, app *controllers.Application, authLimit, searchLimit gin.HandlerFunc) {
+	incoming.POST("/users/signup", authLimit, app.SignUp())
+	incoming.POST("/users/login", authLimit, app.LogIn())
+	incoming.POST("/users/login/2fa", authLimit, app.LogInSecondFactor())
+	incoming.GET("/users/oidc/login", authLimit, app.OIDCStart())
+	incoming.GET("/users/oidc/callback", authLimit, app.OIDCCallback())
+	incoming.POST("/users/forgot-password", authLimit, app.ForgotPassword())
+	incoming.POST("/users/reset-password", authLimit, app.ResetPassword())
+	incoming.GET("/users/verify-email", app.VerifyEmail())
+	incoming.GET("/users/unlock", app.UnlockAccount())
+	incoming.GET("/users/productview", app.ViewProducts())
+	incoming.GET("/users/search", searchLimit, app.SearchProductByQuery())
 }
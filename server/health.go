@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+const pingTimeout = 2 * time.Second
+
+type check struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Healthz answers while the process serves requests at all; orchestrators
+// restart the instance when it stops answering.
+func (server *Server) Healthz() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// Readyz tells whether the instance should receive traffic: MongoDB answers
+// a ping, the indexes are built and the background workers run. It fails
+// from the start of a graceful shutdown. Every dependency is reported on its
+// own so that a failing probe can be told apart.
+func (server *Server) Readyz() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		checks := make(map[string]check)
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), pingTimeout)
+		err := server.client.Ping(ctx, nil)
+		cancel()
+		if err != nil {
+			server.logger.Error("cannot ping MongoDB", "error", err)
+			checks["mongodb"] = check{Status: "failing", Error: "ping failed"}
+		} else {
+			checks["mongodb"] = check{Status: "ok"}
+		}
+
+		if server.indexesReady.Load() {
+			checks["indexes"] = check{Status: "ok"}
+		} else {
+			checks["indexes"] = check{Status: "failing", Error: "indexes are being created"}
+		}
+
+		for name, running := range server.running {
+			if running.Load() {
+				checks[name] = check{Status: "ok"}
+			} else {
+				checks[name] = check{Status: "failing", Error: "worker stopped"}
+			}
+		}
+
+		status, code := "ok", http.StatusOK
+		for _, result := range checks {
+			if result.Status != "ok" {
+				status, code = "failing", http.StatusServiceUnavailable
+			}
+		}
+		if server.shuttingDown.Load() {
+			status, code = "shutting_down", http.StatusServiceUnavailable
+		}
+
+		c.JSON(code, gin.H{"status": status, "checks": checks})
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Run serves HTTP until ctx is cancelled, usually by SIGINT or SIGTERM. It
+// then stops accepting connections, lets in-flight requests finish within
+// the shutdown timeout and closes the server. The error is nil after a
+// clean shutdown.
+func (server *Server) Run(ctx context.Context) error {
+	served := make(chan error, 1)
+	go func() {
+		served <- server.httpServer.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-served:
+		// The listener failed, e.g. the port is taken; nothing to drain.
+	case <-ctx.Done():
+		server.shuttingDown.Store(true)
+		if server.shutdownDelay > 0 {
+			server.logger.Info("shutting down after the delay, /readyz is failing", "delay", server.shutdownDelay.String())
+			time.Sleep(server.shutdownDelay)
+		}
+		server.logger.Info("shutting down, draining requests")
+		err = server.drain()
+	}
+
+	closeCtx, cancel := context.WithTimeout(context.Background(), server.dbTimeout)
+	defer cancel()
+	if closeErr := server.Close(closeCtx); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// drain waits for in-flight requests and drops the connections still open
+// when the shutdown timeout runs out.
+func (server *Server) drain() error {
+	ctx, cancel := context.WithTimeout(context.Background(), server.shutdownTimeout)
+	defer cancel()
+
+	err := server.httpServer.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		server.logger.Warn("shutdown timeout exceeded, closing open connections")
+		_ = server.httpServer.Close()
+	}
+
+	return err
+}
+
+// Close stops the background workers, waits for them to return,
+// disconnects from the database and exports the spans still buffered. It is
+// safe to call more than once; use Run
+// to stop serving HTTP first.
+func (server *Server) Close(ctx context.Context) error {
+	server.closeOnce.Do(func() {
+		server.stopWorkers()
+
+		stopped := make(chan struct{})
+		go func() {
+			server.workers.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			server.logger.Warn("background workers did not stop in time")
+		}
+
+		server.closeErr = errors.Join(server.client.Disconnect(ctx), server.tracing.Shutdown(ctx))
+	})
+
+	return server.closeErr
+}
+
+// background runs work until Close cancels its context; Close waits for it
+// to return.
+func (server *Server) background(work func(ctx context.Context)) {
+	server.workers.Add(1)
+	go func() {
+		defer server.workers.Done()
+		work(server.workersCtx)
+	}()
+}
+
+// startWorker runs a long-lived worker in the background. /readyz fails if
+// it returns before Close.
+func (server *Server) startWorker(name string, work func(ctx context.Context)) {
+	running := new(atomic.Bool)
+	running.Store(true)
+	server.running[name] = running
+
+	server.background(func(ctx context.Context) {
+		defer running.Store(false)
+		work(ctx)
+	})
+}
@@ -0,0 +1,336 @@
+// Package server wires the application together: it connects to MongoDB,
+// loads the signing keys and builds the router. Every Server owns its
+// dependencies, so several can run in one process.
+package server
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/config"
+	"github.com/koinav/ecommerce/controllers"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/keyring"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/metrics"
+	"github.com/koinav/ecommerce/middleware"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/postal"
+	"github.com/koinav/ecommerce/ratelimit"
+	"github.com/koinav/ecommerce/routes"
+	"github.com/koinav/ecommerce/tokens"
+	"github.com/koinav/ecommerce/tracing"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Server struct {
+	logger     *slog.Logger
+	client     *mongo.Client
+	tracing    *tracing.Tracing
+	router     *gin.Engine
+	httpServer *http.Server
+	// shutdownTimeout bounds the drain of in-flight requests in Run and
+	// dbTimeout the disconnect after it. shutdownDelay keeps serving with
+	// /readyz failing, so that load balancers stop sending traffic first.
+	shutdownDelay   time.Duration
+	shutdownTimeout time.Duration
+	dbTimeout       time.Duration
+
+	indexesReady atomic.Bool
+	shuttingDown atomic.Bool
+
+	workersCtx  context.Context
+	stopWorkers context.CancelFunc
+	workers     sync.WaitGroup
+	// running tells for each long-lived worker whether it still runs. It is
+	// filled in New only, so it is read without a lock.
+	running   map[string]*atomic.Bool
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// New connects to the database and builds the router from a validated
+// configuration. ctx bounds the start-up only. logger is the base of the
+// request loggers and is used by the background workers.
+func New(ctx context.Context, cfg config.Config, logger *slog.Logger) (*Server, error) {
+	ctx = logging.NewContext(ctx, logger)
+
+	pricing, err := newPricing(&cfg.Shop, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	addressValidator, err := postal.NewValidator(cfg.Shop.DefaultCountry)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := keyring.Load(cfg.Tokens.KeysDir, cfg.Tokens.KeyOverlap)
+	if err != nil {
+		return nil, err
+	}
+
+	var oidcLogin *controllers.OIDCLogin
+	if cfg.OIDC.Issuer != "" {
+		oidcLogin, err = controllers.NewOIDCLogin(ctx, cfg.OIDC.Issuer, cfg.OIDC.ClientID,
+			cfg.OIDC.ClientSecret, cfg.OIDC.RedirectURL, cfg.OIDC.Scopes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	traces, err := tracing.New(ctx, cfg.Tracing)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := metrics.New()
+	client, err := database.DBSetup(ctx, cfg.Database.URI, cfg.Database.Timeout, pricing.Legacy.Registry(), stats.CommandMonitor(),
+		otelmongo.NewMonitor(otelmongo.WithTracerProvider(traces.Provider), otelmongo.WithCommandAttributeDisabled(true)))
+	if err != nil {
+		_ = traces.Shutdown(context.Background())
+		return nil, err
+	}
+
+	db := client.Database(cfg.Database.Name)
+	userCollection := database.UserData(db, "Users")
+	tokenCollection := database.OneTimeTokenData(db, "OneTimeTokens")
+	sessionCollection := database.SessionData(db, "Sessions")
+	apiKeyCollection := database.APIKeyData(db, "APIKeys")
+
+	server := &Server{
+		logger:          logger,
+		client:          client,
+		tracing:         traces,
+		shutdownDelay:   cfg.Server.ShutdownDelay,
+		shutdownTimeout: cfg.Server.ShutdownTimeout,
+		dbTimeout:       cfg.Database.Timeout,
+		running:         make(map[string]*atomic.Bool),
+	}
+
+	server.router, err = newRouter(server, &cfg, &dependencies{
+		users:            database.NewMongoUsers(userCollection),
+		products:         database.NewMongoProducts(database.ProductData(db, "Products")),
+		carts:            database.NewMongoCarts(userCollection),
+		orders:           database.NewMongoOrders(userCollection),
+		sessions:         database.NewMongoSessions(sessionCollection),
+		oneTimeTokens:    database.NewMongoOneTimeTokens(tokenCollection),
+		apiKeys:          database.NewMongoAPIKeys(apiKeyCollection),
+		shipments:        database.NewMongoShipments(database.ShipmentData(db, "Shipments"), database.ShipmentData(db, "ShippedCounts")),
+		keys:             keys,
+		pricing:          pricing,
+		addressValidator: addressValidator,
+		accountMail:      newAccountMail(&cfg),
+		oidcLogin:        oidcLogin,
+		stats:            stats,
+		traces:           traces,
+	})
+	if err != nil {
+		_ = client.Disconnect(context.Background())
+		_ = traces.Shutdown(context.Background())
+		return nil, err
+	}
+	server.httpServer = &http.Server{
+		Addr:              ":" + cfg.Server.Port,
+		Handler:           server.router,
+		ReadHeaderTimeout: cfg.Server.ReadTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+
+	server.workersCtx, server.stopWorkers = context.WithCancel(logging.NewContext(context.Background(), logger))
+	// Building indexes may outlast the start-up timeout on big collections,
+	// so it runs in the background and /readyz fails until it is done.
+	server.background(func(ctx context.Context) {
+		server.bootstrapIndexes(ctx, userCollection, tokenCollection, sessionCollection, apiKeyCollection)
+	})
+	server.startWorker("keys_reload", func(ctx context.Context) { keys.Watch(ctx, cfg.Tokens.KeysReloadInterval) })
+
+	return server, nil
+}
+
+func (server *Server) Handler() http.Handler {
+	return server.router
+}
+
+// bootstrapIndexes creates the indexes, retrying with a growing delay until
+// it succeeds or ctx is cancelled.
+func (server *Server) bootstrapIndexes(ctx context.Context, userCollection, tokenCollection, sessionCollection, apiKeyCollection *mongo.Collection) {
+	retry := time.Second
+	for {
+		attempt, cancel := context.WithTimeout(ctx, server.dbTimeout)
+		err := ensureIndexes(attempt, userCollection, tokenCollection, sessionCollection, apiKeyCollection)
+		cancel()
+		if err == nil {
+			server.indexesReady.Store(true)
+			server.logger.Info("database indexes are ready")
+			return
+		}
+
+		server.logger.Warn("cannot create database indexes", "retry_in", retry.String(), "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(2*retry, time.Minute)
+	}
+}
+
+func ensureIndexes(ctx context.Context, userCollection, tokenCollection, sessionCollection, apiKeyCollection *mongo.Collection) error {
+	if err := database.EnsureUserIndexes(ctx, userCollection); err != nil {
+		return err
+	}
+	if err := database.EnsureOneTimeTokenIndexes(ctx, tokenCollection); err != nil {
+		return err
+	}
+	if err := database.EnsureSessionIndexes(ctx, sessionCollection); err != nil {
+		return err
+	}
+
+	return database.EnsureAPIKeyIndexes(ctx, apiKeyCollection)
+}
+
+// dependencies are what the handlers are built on. New passes the MongoDB
+// repositories; memory.Store implements them all for tests.
+type dependencies struct {
+	users         database.UserRepository
+	products      database.ProductRepository
+	carts         database.CartRepository
+	orders        database.OrderRepository
+	sessions      database.SessionRepository
+	oneTimeTokens database.OneTimeTokenRepository
+	apiKeys       database.APIKeyRepository
+	shipments     database.ShipmentRepository
+
+	keys             *keyring.Ring
+	pricing          *database.Pricing
+	addressValidator *postal.Validator
+	accountMail      *controllers.AccountMail
+	oidcLogin        *controllers.OIDCLogin
+	stats            *metrics.Metrics
+	traces           *tracing.Tracing
+}
+
+func newRouter(server *Server, cfg *config.Config, deps *dependencies) (*gin.Engine, error) {
+	issuer := tokens.NewIssuer(deps.keys, cfg.Tokens.AccessTTL, cfg.Tokens.RefreshTTL)
+	security := newSecurity(cfg)
+	app := controllers.NewApp(controllers.Services{
+		Users:            deps.users,
+		Products:         deps.products,
+		Carts:            deps.carts,
+		Orders:           deps.orders,
+		Shipments:        deps.shipments,
+		OneTimeTokens:    deps.oneTimeTokens,
+		Sessions:         deps.sessions,
+		APIKeys:          deps.apiKeys,
+		Issuer:           issuer,
+		Keys:             deps.keys,
+		Pricing:          deps.pricing,
+		AddressLimit:     cfg.Shop.AddressBookLimit,
+		AddressValidator: deps.addressValidator,
+		AccountMail:      deps.accountMail,
+		Security:         security,
+		OIDCLogin:        deps.oidcLogin,
+		Metrics:          deps.stats,
+		Background:       server.background,
+	})
+	auth := middleware.NewAuth(issuer, deps.users, deps.sessions, deps.apiKeys)
+	stats, traces := deps.stats, deps.traces
+
+	router := gin.New()
+
+	// Client IPs drive the rate limits, so X-Forwarded-For is believed only
+	// from the listed proxies.
+	if err := router.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		return nil, err
+	}
+
+	// Spans start from the W3C trace context of the request, if any; probes
+	// and scrapes are not traced.
+	router.Use(otelgin.Middleware(cfg.Tracing.ServiceName,
+		otelgin.WithTracerProvider(traces.Provider),
+		otelgin.WithPropagators(traces.Propagator),
+		otelgin.WithGinFilter(func(c *gin.Context) bool {
+			switch c.FullPath() {
+			case "/healthz", "/readyz", "/metrics":
+				return false
+			}
+			return true
+		})))
+	router.Use(stats.HTTP())
+
+	// Probes and scrapes come every few seconds, so they are registered
+	// before the request logger.
+	router.GET("/healthz", server.Healthz())
+	router.GET("/readyz", server.Readyz())
+	router.GET("/metrics", stats.Handler())
+
+	router.Use(middleware.RequestID(server.logger))
+	router.Use(middleware.Recovery())
+	router.Use(middleware.Currency(deps.pricing.Exchange))
+
+	authRate, searchRate := cfg.Server.AuthRatePerMinute, cfg.Server.SearchRatePerMinute
+	routes.UserRoutes(router, app,
+		middleware.RateLimit(ratelimit.NewLimiter(authRate, authRate)),
+		middleware.RateLimit(ratelimit.NewLimiter(searchRate, searchRate)))
+	router.GET("/.well-known/jwks.json", app.JWKS())
+
+	// Admin routes authenticate on their own, as they also take API keys.
+	adminAccess := func(scope string) gin.HandlerFunc {
+		return auth.Admin(security.RequireAdmin2FA, scope)
+	}
+	admin := router.Group("/admin")
+	admin.POST("/addproduct", adminAccess(models.ScopeProductsWrite), app.ProductViewerAdmin())
+	admin.POST("/addshipment", adminAccess(models.ScopeShipmentsWrite), app.CreateShipment())
+	admin.POST("/addtrackingevent", adminAccess(models.ScopeShipmentsWrite), app.AddTrackingEvent())
+	admin.POST("/unlockuser", adminAccess(""), app.AdminUnlockUser())
+	admin.POST("/apikeys", adminAccess(""), app.CreateAPIKey())
+	admin.GET("/apikeys", adminAccess(""), app.ListAPIKeys())
+	admin.DELETE("/apikeys/:id", adminAccess(""), app.RevokeAPIKey())
+
+	router.Use(auth.Authentication())
+
+	router.GET("/users/me", app.GetProfile())
+	router.PATCH("/users/me", app.UpdateProfile())
+	router.PUT("/users/me/email", app.ChangeEmail())
+	router.PUT("/users/me/phone", app.ChangePhone())
+	router.PUT("/users/me/password", app.ChangePassword())
+	router.POST("/users/me/verify-email", app.ResendVerification())
+	router.POST("/users/me/2fa/enroll", app.EnrollTwoFactor())
+	router.POST("/users/me/2fa/confirm", app.ConfirmTwoFactor())
+	router.DELETE("/users/me/2fa", app.DisableTwoFactor())
+	router.GET("/users/me/sessions", app.ListSessions())
+	router.DELETE("/users/me/sessions/:id", app.RevokeSession())
+
+	router.GET("/addtocart", app.AddToCart())
+	router.GET("/removeitem", app.RemoveItem())
+	router.GET("/listcart", app.GetUserCart())
+	router.GET("/addresses", app.ListAddresses())
+	router.GET("/address", app.GetAddress())
+	router.POST("/addaddress", app.AddAddress())
+	router.PUT("/editaddress", app.EditAddress())
+	router.DELETE("/deleteaddress", app.DeleteAddress())
+	router.PUT("/defaultaddress", app.SetDefaultAddress())
+	router.GET("/shippingquote", app.ShippingQuote())
+
+	checkout := router.Group("/")
+	if cfg.Features.RequireVerifiedEmail {
+		checkout.Use(auth.VerifiedEmail())
+	}
+	checkout.GET("/cartcheckout", app.BuyFromCart())
+	checkout.POST("/cartcheckout", app.BuyFromCart())
+	checkout.GET("/instantbuy", app.InstantBuy())
+	checkout.POST("/instantbuy", app.InstantBuy())
+
+	router.GET("/orderdetails", app.OrderDetails())
+
+	return router, nil
+}
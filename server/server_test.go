@@ -0,0 +1,629 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/koinav/ecommerce/config"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/database/memory"
+	"github.com/koinav/ecommerce/keyring"
+	"github.com/koinav/ecommerce/logging"
+	"github.com/koinav/ecommerce/mail"
+	"github.com/koinav/ecommerce/metrics"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/money"
+	"github.com/koinav/ecommerce/postal"
+	"github.com/koinav/ecommerce/tracing"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testShop is a router on memory.Store, so the handlers run without MongoDB.
+type testShop struct {
+	t      *testing.T
+	router http.Handler
+	server *Server
+	store  *memory.Store
+	mail   *mail.MemorySender
+	// phones counts sign-ups, as every account needs a phone of its own.
+	phones int
+}
+
+// newTestShop applies configure, if any, over the test configuration.
+func newTestShop(t *testing.T, configure ...func(cfg *config.Config)) *testShop {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	cfg := config.Default()
+	cfg.Server.PublicURL = "http://shop.test"
+	cfg.Tokens.KeysDir = writeTestKey(t)
+	cfg.Security.BcryptCost = bcrypt.MinCost
+	cfg.Security.LoginIPMaxFailures = 4 * cfg.Security.LoginMaxFailures
+	cfg.Features.RequireAdmin2FA = false
+	cfg.Mail.Driver = "memory"
+	// config.Load fills it in from the default country.
+	cfg.Shop.TaxDefaultCountry = cfg.Shop.DefaultCountry
+	for _, change := range configure {
+		change(&cfg)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	keys, err := keyring.Load(cfg.Tokens.KeysDir, cfg.Tokens.KeyOverlap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pricing, err := newPricing(&cfg.Shop, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addressValidator, err := postal.NewValidator(cfg.Shop.DefaultCountry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traces, err := tracing.New(context.Background(), cfg.Tracing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := memory.NewStore()
+	accountMail := newAccountMail(&cfg)
+	server := &Server{logger: logger}
+	server.workersCtx, server.stopWorkers = context.WithCancel(logging.NewContext(context.Background(), logger))
+	t.Cleanup(func() {
+		server.stopWorkers()
+		server.workers.Wait()
+	})
+	router, err := newRouter(server, &cfg, &dependencies{
+		users:            store,
+		products:         store,
+		carts:            store,
+		orders:           store,
+		sessions:         store,
+		oneTimeTokens:    store,
+		apiKeys:          store,
+		shipments:        store,
+		keys:             keys,
+		pricing:          pricing,
+		addressValidator: addressValidator,
+		accountMail:      accountMail,
+		stats:            metrics.New(),
+		traces:           traces,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testShop{t: t, router: router, server: server, store: store, mail: accountMail.Sender.(*mail.MemorySender)}
+}
+
+func writeTestKey(t *testing.T) string {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(dir, "test.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := json.Marshal(keyring.Manifest{Keys: []keyring.ManifestKey{
+		{ID: "test", File: "test.pem", NotBefore: time.Now().Add(-time.Hour)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, keyring.ManifestFile), manifest, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+// do sends the request with body encoded as JSON unless it is nil, and
+// decodes the response into out unless it is nil.
+func (shop *testShop) do(method, target, token string, body, out any) int {
+	shop.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			shop.t.Fatal(err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+
+	request := httptest.NewRequest(method, target, reader)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	shop.router.ServeHTTP(recorder, request)
+
+	if out != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), out); err != nil {
+			shop.t.Fatalf("%s %s: %v: %s", method, target, err, recorder.Body.String())
+		}
+	}
+
+	return recorder.Code
+}
+
+func (shop *testShop) signUp(email, password string) {
+	shop.t.Helper()
+	shop.phones++
+
+	status := shop.do(http.MethodPost, "/users/signup", "", gin.H{
+		"first_name": "Anna",
+		"last_name":  "Petrova",
+		"email":      email,
+		"phone":      fmt.Sprintf("+7900%07d", shop.phones),
+		"password":   password,
+	}, nil)
+	if status != http.StatusCreated {
+		shop.t.Fatalf("sign up %s: status %d", email, status)
+	}
+}
+
+func (shop *testShop) logIn(email, password string) string {
+	shop.t.Helper()
+
+	var response struct {
+		Token string `json:"token"`
+	}
+	if status := shop.do(http.MethodPost, "/users/login", "", gin.H{"email": email, "password": password}, &response); status != http.StatusOK {
+		shop.t.Fatalf("log in %s: status %d", email, status)
+	}
+
+	return response.Token
+}
+
+// addProduct stores a product priced in roubles and returns its ID.
+func (shop *testShop) addProduct(name string, kopecks int64) string {
+	shop.t.Helper()
+
+	product := models.Product{ProductID: primitive.NewObjectID(), ProductName: name, Price: money.New(kopecks, "RUB")}
+	if err := shop.store.AddProduct(context.Background(), &product); err != nil {
+		shop.t.Fatal(err)
+	}
+
+	return product.ProductID.Hex()
+}
+
+// cartSize returns the number of items in the cart of the token's user.
+func (shop *testShop) cartSize(token string) int {
+	shop.t.Helper()
+
+	var cart struct {
+		Items []models.ProductInCart `json:"items"`
+	}
+	if status := shop.do(http.MethodGet, "/listcart", token, nil, &cart); status != http.StatusOK {
+		shop.t.Fatalf("list cart: status %d", status)
+	}
+
+	return len(cart.Items)
+}
+
+var linkToken = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+// lastLinkToken returns the token of the last link emailed to the address,
+// once the emails sent in the background are out.
+func (shop *testShop) lastLinkToken(to string) string {
+	shop.t.Helper()
+	shop.server.workers.Wait()
+
+	messages := shop.mail.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].To != to {
+			continue
+		}
+		if match := linkToken.FindStringSubmatch(messages[i].Body); match != nil {
+			return match[1]
+		}
+	}
+
+	shop.t.Fatalf("no link was emailed to %s", to)
+	return ""
+}
+
+func TestLogInAndSessions(t *testing.T) {
+	shop := newTestShop(t)
+	shop.signUp("anna@example.com", "secret1")
+
+	token := shop.logIn("anna@example.com", "secret1")
+
+	var profile models.Profile
+	if status := shop.do(http.MethodGet, "/users/me", token, nil, &profile); status != http.StatusOK {
+		t.Fatalf("profile: status %d", status)
+	}
+	if profile.Email != "anna@example.com" {
+		t.Errorf("profile email = %q", profile.Email)
+	}
+
+	var sessions []models.Session
+	if status := shop.do(http.MethodGet, "/users/me/sessions", token, nil, &sessions); status != http.StatusOK {
+		t.Fatalf("sessions: status %d", status)
+	}
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Fatalf("sessions = %+v, want the current one", sessions)
+	}
+
+	if status := shop.do(http.MethodDelete, "/users/me/sessions/"+sessions[0].SessionID.Hex(), token, nil, nil); status != http.StatusOK {
+		t.Fatalf("revoke session: status %d", status)
+	}
+	if status := shop.do(http.MethodGet, "/users/me", token, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("profile after revoking the session: status %d, want 401", status)
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	shop := newTestShop(t)
+	shop.signUp("anna@example.com", "secret1")
+
+	status := shop.do(http.MethodPost, "/users/login", "", gin.H{"email": "anna@example.com", "password": "wrong!"}, nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", status)
+	}
+}
+
+func TestLockedAccountAnswersLikeUnknownEmail(t *testing.T) {
+	shop := newTestShop(t, func(cfg *config.Config) { cfg.Security.LoginMaxFailures = 2 })
+	shop.signUp("anna@example.com", "secret1")
+
+	login := func(email, password string) (int, string) {
+		var body struct {
+			Error string `json:"error"`
+		}
+		status := shop.do(http.MethodPost, "/users/login", "", gin.H{"email": email, "password": password}, &body)
+		return status, body.Error
+	}
+	for range 2 {
+		login("anna@example.com", "wrong!")
+	}
+
+	unknownStatus, unknownError := login("boris@example.com", "secret1")
+	lockedStatus, lockedError := login("anna@example.com", "secret1")
+	if lockedStatus != unknownStatus || lockedError != unknownError {
+		t.Errorf("locked account: %d %q, unknown email: %d %q", lockedStatus, lockedError, unknownStatus, unknownError)
+	}
+	if lockedStatus != http.StatusUnauthorized {
+		t.Errorf("locked account: status %d, want 401", lockedStatus)
+	}
+}
+
+func TestLongPassword(t *testing.T) {
+	shop := newTestShop(t)
+
+	// 73 characters fail validation; 72 Cyrillic ones pass it but are 144
+	// bytes, more than bcrypt takes.
+	for _, password := range []string{strings.Repeat("a", 73), strings.Repeat("я", 72)} {
+		status := shop.do(http.MethodPost, "/users/signup", "", gin.H{
+			"first_name": "Anna",
+			"last_name":  "Petrova",
+			"email":      "anna@example.com",
+			"phone":      "+79001234567",
+			"password":   password,
+		}, nil)
+		if status != http.StatusBadRequest {
+			t.Errorf("sign up with a %d byte password: status %d, want 400", len(password), status)
+		}
+	}
+}
+
+func TestMultiBytePassword(t *testing.T) {
+	shop := newTestShop(t)
+	// 72 characters, as validation allows, but 144 bytes, more than bcrypt takes.
+	password := strings.Repeat("я", 72)
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	status := shop.do(http.MethodPost, "/users/signup", "", gin.H{
+		"first_name": "Anna",
+		"last_name":  "Petrova",
+		"email":      "anna@example.com",
+		"phone":      "+79001234567",
+		"password":   password,
+	}, &body)
+	if status != http.StatusBadRequest || body.Error != "password is too long" {
+		t.Errorf("sign up: status %d, error %q, want 400 %q", status, body.Error, "password is too long")
+	}
+
+	shop.signUp("anna@example.com", "secret1")
+	token := shop.logIn("anna@example.com", "secret1")
+	body.Error = ""
+	status = shop.do(http.MethodPut, "/users/me/password", token, gin.H{
+		"current_password": "secret1",
+		"new_password":     password,
+	}, &body)
+	if status != http.StatusBadRequest || body.Error != "password is too long" {
+		t.Errorf("change: status %d, error %q, want 400 %q", status, body.Error, "password is too long")
+	}
+	// The old password still works.
+	shop.logIn("anna@example.com", "secret1")
+}
+
+func TestVerifyEmail(t *testing.T) {
+	shop := newTestShop(t)
+	shop.signUp("anna@example.com", "secret1")
+
+	verifyToken := shop.lastLinkToken("anna@example.com")
+	if status := shop.do(http.MethodGet, "/users/verify-email?token="+verifyToken, "", nil, nil); status != http.StatusOK {
+		t.Fatalf("verify: status %d", status)
+	}
+	if status := shop.do(http.MethodGet, "/users/verify-email?token="+verifyToken, "", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("second use of the link: status %d, want 400", status)
+	}
+
+	var profile models.Profile
+	shop.do(http.MethodGet, "/users/me", shop.logIn("anna@example.com", "secret1"), nil, &profile)
+	if !profile.EmailVerified {
+		t.Error("email is not verified")
+	}
+}
+
+func TestVerifyEmailAfterEmailChange(t *testing.T) {
+	shop := newTestShop(t)
+	shop.signUp("anna@example.com", "secret1")
+	verifyToken := shop.lastLinkToken("anna@example.com")
+
+	// Changed in the store, the email gets no new link that would void the
+	// old one, so only the email saved with the token stops it.
+	anna, err := shop.store.FindUserByEmail(context.Background(), "anna@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = shop.store.ChangeEmail(context.Background(), anna.UserID, "anna@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := shop.do(http.MethodGet, "/users/verify-email?token="+verifyToken, "", nil, nil); status != http.StatusBadRequest {
+		t.Fatalf("link sent to the old email: status %d, want 400", status)
+	}
+	var profile models.Profile
+	shop.do(http.MethodGet, "/users/me", shop.logIn("anna@example.org", "secret1"), nil, &profile)
+	if profile.EmailVerified {
+		t.Error("the new email was verified by the link sent to the old one")
+	}
+}
+
+func TestCheckoutNeedsVerifiedEmail(t *testing.T) {
+	shop := newTestShop(t, func(cfg *config.Config) { cfg.Features.RequireVerifiedEmail = true })
+	shop.signUp("anna@example.com", "secret1")
+	shop.signUp("boris@example.com", "secret1")
+
+	verifyToken := shop.lastLinkToken("anna@example.com")
+	if status := shop.do(http.MethodGet, "/users/verify-email?token="+verifyToken, "", nil, nil); status != http.StatusOK {
+		t.Fatalf("verify: status %d", status)
+	}
+	anna, err := shop.store.FindUserByEmail(context.Background(), "anna@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The userID of a verified account must not let boris past the check.
+	status := shop.do(http.MethodGet, "/cartcheckout?userID="+anna.UserID, shop.logIn("boris@example.com", "secret1"), nil, nil)
+	if status != http.StatusForbidden {
+		t.Errorf("checkout of an unverified user: status %d, want 403", status)
+	}
+}
+
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	shop := newTestShop(t)
+
+	if status := shop.do(http.MethodPost, "/users/forgot-password", "", gin.H{"email": "nobody@example.com"}, nil); status != http.StatusOK {
+		t.Fatalf("forgot password: status %d, want 200", status)
+	}
+	shop.server.workers.Wait()
+	if messages := shop.mail.Messages(); len(messages) != 0 {
+		t.Errorf("emails sent = %+v, want none", messages)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	shop := newTestShop(t)
+	shop.signUp("anna@example.com", "secret1")
+	oldToken := shop.logIn("anna@example.com", "secret1")
+
+	if status := shop.do(http.MethodPost, "/users/forgot-password", "", gin.H{"email": "anna@example.com"}, nil); status != http.StatusOK {
+		t.Fatalf("forgot password: status %d", status)
+	}
+	resetToken := shop.lastLinkToken("anna@example.com")
+
+	status := shop.do(http.MethodPost, "/users/reset-password", "", gin.H{"token": resetToken, "new_password": "secret2"}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("reset password: status %d", status)
+	}
+
+	if status = shop.do(http.MethodGet, "/users/me", oldToken, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("old token after reset: status %d, want 401", status)
+	}
+	shop.logIn("anna@example.com", "secret2")
+}
+
+func TestCartOfAnotherUser(t *testing.T) {
+	shop := newTestShop(t)
+	shop.signUp("anna@example.com", "secret1")
+	shop.signUp("boris@example.com", "secret1")
+	anna := shop.logIn("anna@example.com", "secret1")
+	boris := shop.logIn("boris@example.com", "secret1")
+	productID := shop.addProduct("Tea", 30000)
+
+	if status := shop.do(http.MethodGet, "/addtocart?productID="+productID, boris, nil, nil); status != http.StatusOK {
+		t.Fatalf("add to cart: status %d", status)
+	}
+	borisUser, err := shop.store.FindUserByEmail(context.Background(), "boris@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The userID of boris only ever reaches the cart of anna.
+	query := "productID=" + productID + "&userID=" + borisUser.UserID
+	var cart struct {
+		Items []models.ProductInCart `json:"items"`
+	}
+	shop.do(http.MethodGet, "/listcart?userID="+borisUser.UserID, anna, nil, &cart)
+	if len(cart.Items) != 0 {
+		t.Errorf("anna sees %d items of the cart of boris", len(cart.Items))
+	}
+	shop.do(http.MethodGet, "/removeitem?"+query, anna, nil, nil)
+	shop.do(http.MethodGet, "/addtocart?"+query, anna, nil, nil)
+	if size := shop.cartSize(boris); size != 1 {
+		t.Errorf("cart of boris has %d items, want 1", size)
+	}
+	if size := shop.cartSize(anna); size != 1 {
+		t.Errorf("cart of anna has %d items, want 1", size)
+	}
+}
+
+func TestCheckoutEmptyCart(t *testing.T) {
+	shop := newTestShop(t)
+	shop.signUp("anna@example.com", "secret1")
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	status := shop.do(http.MethodGet, "/cartcheckout", shop.logIn("anna@example.com", "secret1"), nil, &body)
+	if status != http.StatusBadRequest || body.Error != database.ErrEmptyCart.Error() {
+		t.Errorf("checkout of an empty cart: status %d, error %q, want 400 %q", status, body.Error, database.ErrEmptyCart)
+	}
+	anna, err := shop.store.FindUserByEmail(context.Background(), "anna@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anna.OrderStatus) != 0 {
+		t.Errorf("orders = %d, want none", len(anna.OrderStatus))
+	}
+}
+
+func TestCheckoutKeepsItemsAddedMeanwhile(t *testing.T) {
+	shop := newTestShop(t)
+	ctx := context.Background()
+	shop.signUp("anna@example.com", "secret1")
+	anna := shop.logIn("anna@example.com", "secret1")
+	productID := shop.addProduct("Tea", 30000)
+
+	shop.do(http.MethodGet, "/addtocart?productID="+productID, anna, nil, nil)
+	user, err := shop.store.FindUserByEmail(ctx, "anna@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The order is made from the cart as read before the second item.
+	order := models.Order{OrderID: primitive.NewObjectID(), OrderCart: user.UserCart}
+	shop.do(http.MethodGet, "/addtocart?productID="+productID, anna, nil, nil)
+
+	if err = shop.store.PlaceOrder(ctx, user.UserID, &order, true); !errors.Is(err, database.ErrCartChanged) {
+		t.Errorf("place order = %v, want %v", err, database.ErrCartChanged)
+	}
+	if size := shop.cartSize(anna); size != 2 {
+		t.Errorf("cart has %d items, want 2", size)
+	}
+	user, err = shop.store.FindUserByEmail(ctx, "anna@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.OrderStatus) != 0 {
+		t.Errorf("orders = %d, want none", len(user.OrderStatus))
+	}
+}
+
+func TestShipments(t *testing.T) {
+	shop := newTestShop(t)
+	ctx := context.Background()
+
+	// Admins are not signed up but made in the database.
+	password, err := bcrypt.GenerateFromPassword([]byte("secret1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminID := primitive.NewObjectID()
+	err = shop.store.CreateUser(ctx, &models.User{
+		ID:       adminID,
+		UserID:   adminID.Hex(),
+		Email:    "admin@example.com",
+		Phone:    "+79000000000",
+		Password: string(password),
+		Role:     models.RoleAdmin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminToken := shop.logIn("admin@example.com", "secret1")
+
+	var created struct {
+		Key string `json:"key"`
+	}
+	status := shop.do(http.MethodPost, "/admin/apikeys", adminToken,
+		gin.H{"name": "warehouse", "scopes": []string{models.ScopeShipmentsWrite}}, &created)
+	if status != http.StatusCreated {
+		t.Fatalf("create API key: status %d", status)
+	}
+
+	shop.signUp("anna@example.com", "secret1")
+	customer, err := shop.store.FindUserByEmail(ctx, "anna@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	productID := primitive.NewObjectID()
+	order := models.Order{
+		OrderID:   primitive.NewObjectID(),
+		OrderCart: []models.ProductInCart{{ProductID: productID}, {ProductID: productID}},
+	}
+	if err = shop.store.PlaceOrder(ctx, customer.UserID, &order, false); err != nil {
+		t.Fatal(err)
+	}
+
+	shipment := gin.H{
+		"order_id":        order.OrderID.Hex(),
+		"carrier":         "CDEK",
+		"tracking_number": "1001",
+		"items":           []gin.H{{"product_id": productID.Hex(), "quantity": 2}},
+	}
+	if status = shop.do(http.MethodPost, "/admin/addshipment", created.Key, shipment, nil); status != http.StatusCreated {
+		t.Fatalf("create shipment: status %d", status)
+	}
+	if status = shop.do(http.MethodPost, "/admin/addshipment", created.Key, shipment, nil); status != http.StatusConflict {
+		t.Errorf("shipping more than ordered: status %d, want 409", status)
+	}
+
+	var details struct {
+		Status string `json:"fulfillment_status"`
+	}
+	target := "/orderdetails?orderID=" + order.OrderID.Hex()
+	if status = shop.do(http.MethodGet, target, shop.logIn("anna@example.com", "secret1"), nil, &details); status != http.StatusOK {
+		t.Fatalf("order details: status %d", status)
+	}
+	if details.Status != "shipped" {
+		t.Errorf("fulfillment status = %q, want shipped", details.Status)
+	}
+
+	// Orders of other users are not found, whatever the query says.
+	shop.signUp("boris@example.com", "secret1")
+	if status = shop.do(http.MethodGet, target+"&userID="+customer.UserID, shop.logIn("boris@example.com", "secret1"), nil, nil); status != http.StatusNotFound {
+		t.Errorf("order details of another user: status %d, want 404", status)
+	}
+}
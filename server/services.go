@@ -0,0 +1,110 @@
+package server
+
+import (
+	"github.com/koinav/ecommerce/config"
+	"github.com/koinav/ecommerce/controllers"
+	"github.com/koinav/ecommerce/database"
+	"github.com/koinav/ecommerce/mail"
+	"github.com/koinav/ecommerce/money"
+	"github.com/koinav/ecommerce/ratelimit"
+	"github.com/koinav/ecommerce/shipping"
+	"github.com/koinav/ecommerce/tax"
+	"log/slog"
+)
+
+func newPricing(shop *config.Shop, logger *slog.Logger) (*database.Pricing, error) {
+	legacy := newLegacyMoney(shop)
+	exchange := money.NewExchangeRates(shop.DefaultCurrency, legacy.Rounding)
+	if shop.ExchangeRatesFile != "" {
+		rates, err := money.LoadExchangeRates(shop.ExchangeRatesFile, legacy.Rounding, logger)
+		if err != nil {
+			return nil, err
+		}
+		exchange = rates
+	}
+
+	taxRules := tax.DefaultRules
+	if shop.TaxRulesFile != "" {
+		rules, err := tax.LoadRules(shop.TaxRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		taxRules = rules
+	}
+
+	shippingMethods := shipping.DefaultMethods
+	if shop.ShippingMethodsFile != "" {
+		methods, err := shipping.LoadMethods(shop.ShippingMethodsFile)
+		if err != nil {
+			return nil, err
+		}
+		shippingMethods = methods
+	}
+
+	return &database.Pricing{
+		TaxCalculator: tax.NewRulesCalculator(taxRules, shop.TaxDefaultCountry, shop.PricesIncludeTax, legacy.Rounding),
+		ShippingRates: shipping.NewRates(shippingMethods, exchange),
+		Exchange:      exchange,
+		Legacy:        legacy,
+	}, nil
+}
+
+// newLegacyMoney reads prices without a currency in the default currency of
+// the shop, rounded as configured.
+func newLegacyMoney(shop *config.Shop) money.Legacy {
+	legacy := money.Legacy{Currency: shop.DefaultCurrency, Rounding: money.HalfUp}
+	if shop.MoneyRounding == "half_even" {
+		legacy.Rounding = money.HalfEven
+	}
+
+	return legacy
+}
+
+func newAccountMail(cfg *config.Config) *controllers.AccountMail {
+	var mailer mail.Sender
+	switch cfg.Mail.Driver {
+	case "memory":
+		mailer = mail.NewMemorySender()
+	case "smtp":
+		mailer = mail.NewSMTPSender(cfg.Mail.SMTPHost, cfg.Mail.SMTPPort,
+			cfg.Mail.SMTPUsername, cfg.Mail.SMTPPassword, cfg.Mail.From)
+	default:
+		mailer = mail.NewFileSender(cfg.Mail.File)
+	}
+
+	publicURL := cfg.Server.PublicURL
+	accountMail := &controllers.AccountMail{
+		Sender:         mailer,
+		ResetURL:       publicURL + "/users/reset-password",
+		ResetTTL:       cfg.Mail.PasswordResetTTL,
+		VerifyURL:      publicURL + "/users/verify-email",
+		VerifyTTL:      cfg.Mail.VerificationTTL,
+		ResendInterval: cfg.Mail.VerificationResendInterval,
+		UnlockURL:      publicURL + "/users/unlock",
+		UnlockTTL:      cfg.Security.AccountUnlockTTL,
+	}
+	if cfg.Mail.PasswordResetURL != "" {
+		accountMail.ResetURL = cfg.Mail.PasswordResetURL
+	}
+
+	return accountMail
+}
+
+func newSecurity(cfg *config.Config) *controllers.Security {
+	accountLockout := ratelimit.Policy{
+		Threshold: cfg.Security.LoginMaxFailures,
+		Base:      cfg.Security.LoginLockout,
+		Max:       cfg.Security.LoginLockoutMax,
+	}
+	ipLockout := accountLockout
+	ipLockout.Threshold = cfg.Security.LoginIPMaxFailures
+
+	return &controllers.Security{
+		BcryptCost:      cfg.Security.BcryptCost,
+		TOTPIssuer:      cfg.Security.TOTPIssuer,
+		PreAuthTTL:      cfg.Tokens.PreAuthTTL,
+		RequireAdmin2FA: cfg.Features.RequireAdmin2FA,
+		AccountLockout:  accountLockout,
+		IPBackoff:       ratelimit.NewBackoff(ipLockout),
+	}
+}
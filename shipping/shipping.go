@@ -0,0 +1,193 @@
+package shipping
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/money"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	FlatRate    = "flat_rate"
+	WeightBased = "weight_based"
+	FreeAbove   = "free_above"
+)
+
+// volumetricDivisor turns cubic centimetres into billable grams, the usual
+// 5000 cm3 per kilogram used by couriers.
+const volumetricDivisor = 5
+
+var (
+	ErrMethodNotAvailable = errors.New("shipping method is not available for this order")
+	ErrCantLoadMethods    = errors.New("cannot load shipping methods")
+)
+
+type Method struct {
+	Code      string      `json:"code"`
+	Name      string      `json:"name"`
+	Kind      string      `json:"kind"`
+	Price     money.Money `json:"price"`
+	PerKg     money.Money `json:"per_kg"`
+	MaxWeight uint        `json:"max_weight"`
+	Threshold money.Money `json:"threshold"`
+	// PostCodePrefixes limits the method to the listed delivery regions.
+	PostCodePrefixes []string `json:"post_code_prefixes"`
+}
+
+type Quote struct {
+	Code   string      `json:"code"`
+	Name   string      `json:"name"`
+	Price  money.Money `json:"price"`
+	Weight uint        `json:"weight"`
+}
+
+var DefaultMethods = []Method{
+	{Code: "courier", Name: "Courier", Kind: FlatRate, Price: money.New(50000, "RUB")},
+	{Code: "post", Name: "Russian Post", Kind: WeightBased,
+		Price: money.New(25000, "RUB"), PerKg: money.New(10000, "RUB"), MaxWeight: 20000},
+	{Code: "free", Name: "Free delivery", Kind: FreeAbove, Threshold: money.New(500000, "RUB")},
+}
+
+type Rates struct {
+	methods  []Method
+	exchange *money.ExchangeRates
+}
+
+func NewRates(methods []Method, exchange *money.ExchangeRates) *Rates {
+	return &Rates{methods: methods, exchange: exchange}
+}
+
+func LoadMethods(path string) ([]Method, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCantLoadMethods, err)
+	}
+
+	var methods []Method
+	if err = json.Unmarshal(data, &methods); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCantLoadMethods, err)
+	}
+
+	return methods, nil
+}
+
+// Quotes prices every available method in currency, which the items must
+// already be priced in.
+func (rates *Rates) Quotes(items []models.ProductInCart, address *models.Address, currency string) ([]Quote, error) {
+	weight := BillableWeight(items)
+	subtotal := money.Zero(currency)
+	for _, item := range items {
+		var err error
+		if subtotal, err = subtotal.Add(item.Price); err != nil {
+			return nil, err
+		}
+	}
+
+	quotes := make([]Quote, 0, len(rates.methods))
+	for _, method := range rates.methods {
+		if !method.delivers(address) {
+			continue
+		}
+
+		price, ok, err := method.quote(rates.exchange, weight, subtotal)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		quotes = append(quotes, Quote{Code: method.Code, Name: method.Name, Price: price, Weight: weight})
+	}
+
+	sort.SliceStable(quotes, func(i, j int) bool { return quotes[i].Price.Amount < quotes[j].Price.Amount })
+
+	return quotes, nil
+}
+
+// Select returns the quote for the requested method, or the cheapest
+// available one when code is empty.
+func (rates *Rates) Select(items []models.ProductInCart, address *models.Address, currency, code string) (Quote, error) {
+	quotes, err := rates.Quotes(items, address, currency)
+	if err != nil {
+		return Quote{}, err
+	}
+
+	for _, quote := range quotes {
+		if code == "" || quote.Code == code {
+			return quote, nil
+		}
+	}
+
+	return Quote{}, ErrMethodNotAvailable
+}
+
+func (method Method) delivers(address *models.Address) bool {
+	if len(method.PostCodePrefixes) == 0 {
+		return true
+	}
+	if address == nil {
+		return false
+	}
+
+	postCode := strings.ReplaceAll(address.PostCode, " ", "")
+	for _, prefix := range method.PostCodePrefixes {
+		if strings.HasPrefix(postCode, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (method Method) quote(exchange *money.ExchangeRates, weight uint, subtotal money.Money) (money.Money, bool, error) {
+	currency := subtotal.Currency
+
+	switch method.Kind {
+	case FlatRate:
+		price, err := exchange.Convert(method.Price, currency)
+		return price, err == nil, err
+	case WeightBased:
+		if method.MaxWeight > 0 && weight > method.MaxWeight {
+			return money.Money{}, false, nil
+		}
+		kilograms := int64((weight + 999) / 1000)
+		perKg, err := method.PerKg.Mul(kilograms)
+		if err != nil {
+			return money.Money{}, false, err
+		}
+		price, err := method.Price.Add(perKg)
+		if err != nil {
+			return money.Money{}, false, err
+		}
+
+		price, err = exchange.Convert(price, currency)
+		return price, err == nil, err
+	case FreeAbove:
+		threshold, err := exchange.Convert(method.Threshold, currency)
+		if err != nil {
+			return money.Money{}, false, err
+		}
+		cmp, err := subtotal.Cmp(threshold)
+		if err != nil {
+			return money.Money{}, false, err
+		}
+		return money.Zero(currency), cmp >= 0, nil
+	}
+
+	return money.Money{}, false, nil
+}
+
+func BillableWeight(items []models.ProductInCart) uint {
+	var total uint
+	for _, item := range items {
+		volume := item.Dimensions.Length * item.Dimensions.Width * item.Dimensions.Height
+		total += max(item.Weight, volume/volumetricDivisor)
+	}
+
+	return total
+}
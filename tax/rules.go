@@ -0,0 +1,163 @@
+package tax
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/money"
+	"math/big"
+	"os"
+	"strings"
+)
+
+type Rule struct {
+	Name           string  `json:"name"`
+	Country        string  `json:"country"`
+	PostCodePrefix string  `json:"post_code_prefix"`
+	Category       string  `json:"category"`
+	Rate           float64 `json:"rate"`
+}
+
+var DefaultRules = []Rule{
+	{Name: "VAT", Country: "RU", Rate: 0.20},
+	{Name: "VAT reduced", Country: "RU", Category: "food", Rate: 0.10},
+	{Name: "VAT reduced", Country: "RU", Category: "children", Rate: 0.10},
+	{Name: "VAT reduced", Country: "RU", Category: "books", Rate: 0.10},
+	{Name: "VAT reduced", Country: "RU", Category: "medical", Rate: 0.10},
+}
+
+type RulesCalculator struct {
+	rules            []Rule
+	defaultCountry   string
+	pricesIncludeTax bool
+	rounding         money.RoundingMode
+}
+
+// NewRulesCalculator rounds tax amounts to whole minor units with rounding.
+func NewRulesCalculator(rules []Rule, defaultCountry string, pricesIncludeTax bool, rounding money.RoundingMode) *RulesCalculator {
+	return &RulesCalculator{
+		rules:            rules,
+		defaultCountry:   strings.ToUpper(defaultCountry),
+		pricesIncludeTax: pricesIncludeTax,
+		rounding:         rounding,
+	}
+}
+
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCantLoadRules, err)
+	}
+
+	var rules []Rule
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCantLoadRules, err)
+	}
+
+	return rules, nil
+}
+
+func (calc *RulesCalculator) Calculate(dest Destination, currency string, items []models.ProductInCart) (Result, error) {
+	country := strings.ToUpper(dest.Country)
+	if country == "" {
+		country = calc.defaultCountry
+	}
+	postCode := strings.ReplaceAll(dest.PostCode, " ", "")
+
+	result := Result{
+		Subtotal: money.Zero(currency),
+		Tax:      money.Zero(currency),
+		Included: calc.pricesIncludeTax,
+	}
+	bases := make(map[Rule]money.Money)
+	order := make([]Rule, 0)
+
+	for _, item := range items {
+		rule, ok := calc.match(country, postCode, item.Category)
+		if !ok {
+			return Result{}, ErrNoRuleForDestination
+		}
+
+		base, seen := bases[rule]
+		if !seen {
+			base = money.Zero(currency)
+			order = append(order, rule)
+		}
+
+		var err error
+		if bases[rule], err = base.Add(item.Price); err != nil {
+			return Result{}, err
+		}
+		if result.Subtotal, err = result.Subtotal.Add(item.Price); err != nil {
+			return Result{}, err
+		}
+	}
+
+	for _, rule := range order {
+		base := bases[rule]
+
+		rate, err := money.Ratio(rule.Rate)
+		if err != nil {
+			return Result{}, err
+		}
+		if calc.pricesIncludeTax {
+			rate.Quo(rate, new(big.Rat).Add(big.NewRat(1, 1), rate))
+		}
+
+		amount, err := base.MulRat(rate, calc.rounding)
+		if err != nil {
+			return Result{}, err
+		}
+
+		line := models.TaxLine{
+			Name:     rule.Name,
+			Category: rule.Category,
+			Rate:     rule.Rate,
+			Taxable:  base,
+			Amount:   amount,
+		}
+		result.Lines = append(result.Lines, line)
+		if result.Tax, err = result.Tax.Add(line.Amount); err != nil {
+			return Result{}, err
+		}
+	}
+
+	result.Total = result.Subtotal
+	if !calc.pricesIncludeTax {
+		var err error
+		if result.Total, err = result.Total.Add(result.Tax); err != nil {
+			return Result{}, err
+		}
+	}
+
+	return result, nil
+}
+
+// match picks the most specific rule: a post code region beats the whole
+// country, and a category rate beats the general one within the same region.
+func (calc *RulesCalculator) match(country, postCode, category string) (Rule, bool) {
+	var best Rule
+	bestScore := -1
+
+	for _, rule := range calc.rules {
+		if !strings.EqualFold(rule.Country, country) {
+			continue
+		}
+		if rule.PostCodePrefix != "" && !strings.HasPrefix(postCode, rule.PostCodePrefix) {
+			continue
+		}
+		if rule.Category != "" && !strings.EqualFold(rule.Category, category) {
+			continue
+		}
+
+		score := len(rule.PostCodePrefix) * 2
+		if rule.Category != "" {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = rule, score
+		}
+	}
+
+	return best, bestScore >= 0
+}
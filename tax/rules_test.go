@@ -0,0 +1,91 @@
+package tax
+
+import (
+	"errors"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/money"
+	"testing"
+)
+
+var testRules = []Rule{
+	{Name: "VAT", Country: "RU", Rate: 0.20},
+	{Name: "VAT food", Country: "RU", Category: "food", Rate: 0.10},
+	{Name: "Region", Country: "RU", PostCodePrefix: "10", Rate: 0.18},
+	{Name: "City", Country: "RU", PostCodePrefix: "101", Rate: 0.15},
+	{Name: "City food", Country: "RU", PostCodePrefix: "101", Category: "food", Rate: 0.05},
+}
+
+func item(kopecks int64, category string) models.ProductInCart {
+	return models.ProductInCart{Price: money.New(kopecks, "RUB"), Category: category}
+}
+
+func TestRulesCalculator(t *testing.T) {
+	tests := []struct {
+		name      string
+		dest      Destination
+		included  bool
+		rounding  money.RoundingMode
+		items     []models.ProductInCart
+		wantRules []string
+		wantTax   int64
+		wantTotal int64
+		wantErr   error
+	}{
+		{"exclusive", Destination{Country: "RU", PostCode: "190000"}, false, money.HalfUp,
+			[]models.ProductInCart{item(1000, "")}, []string{"VAT"}, 200, 1200, nil},
+		{"inclusive", Destination{Country: "RU", PostCode: "190000"}, true, money.HalfUp,
+			[]models.ProductInCart{item(1200, "")}, []string{"VAT"}, 200, 1200, nil},
+		{"inclusive rounded", Destination{Country: "RU"}, true, money.HalfUp,
+			[]models.ProductInCart{item(1000, "")}, []string{"VAT"}, 167, 1000, nil},
+		{"category", Destination{Country: "ru"}, false, money.HalfUp,
+			[]models.ProductInCart{item(1000, "food"), item(500, "")}, []string{"VAT food", "VAT"}, 200, 1700, nil},
+		{"longest prefix", Destination{Country: "RU", PostCode: "101000"}, false, money.HalfUp,
+			[]models.ProductInCart{item(1000, "")}, []string{"City"}, 150, 1150, nil},
+		{"prefix with spaces", Destination{Country: "RU", PostCode: "101 000"}, false, money.HalfUp,
+			[]models.ProductInCart{item(1000, "")}, []string{"City"}, 150, 1150, nil},
+		{"category within prefix", Destination{Country: "RU", PostCode: "101000"}, false, money.HalfUp,
+			[]models.ProductInCart{item(1000, "food")}, []string{"City food"}, 50, 1050, nil},
+		{"prefix beats category", Destination{Country: "RU", PostCode: "102000"}, false, money.HalfUp,
+			[]models.ProductInCart{item(1000, "food")}, []string{"Region"}, 180, 1180, nil},
+		{"default country", Destination{PostCode: "190000"}, false, money.HalfUp,
+			[]models.ProductInCart{item(1000, "")}, []string{"VAT"}, 200, 1200, nil},
+		{"half up", Destination{Country: "RU"}, false, money.HalfUp,
+			[]models.ProductInCart{item(25, "food")}, []string{"VAT food"}, 3, 28, nil},
+		{"half even", Destination{Country: "RU"}, false, money.HalfEven,
+			[]models.ProductInCart{item(25, "food")}, []string{"VAT food"}, 2, 27, nil},
+		{"unknown country", Destination{Country: "DE"}, false, money.HalfUp,
+			[]models.ProductInCart{item(1000, "")}, nil, 0, 0, ErrNoRuleForDestination},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calc := NewRulesCalculator(testRules, "RU", tt.included, tt.rounding)
+			result, err := calc.Calculate(tt.dest, "RUB", tt.items)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			var rules []string
+			for _, line := range result.Lines {
+				rules = append(rules, line.Name)
+			}
+			if len(rules) != len(tt.wantRules) {
+				t.Fatalf("rules = %v, want %v", rules, tt.wantRules)
+			}
+			for i := range rules {
+				if rules[i] != tt.wantRules[i] {
+					t.Errorf("rules = %v, want %v", rules, tt.wantRules)
+				}
+			}
+			if result.Tax != money.New(tt.wantTax, "RUB") || result.Total != money.New(tt.wantTotal, "RUB") {
+				t.Errorf("tax %v, total %v; want %d, %d", result.Tax, result.Total, tt.wantTax, tt.wantTotal)
+			}
+			if result.Included != tt.included {
+				t.Errorf("included = %t, want %t", result.Included, tt.included)
+			}
+		})
+	}
+}
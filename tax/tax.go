@@ -0,0 +1,38 @@
+package tax
+
+import (
+	"errors"
+	"github.com/koinav/ecommerce/models"
+	"github.com/koinav/ecommerce/money"
+)
+
+var (
+	ErrNoRuleForDestination = errors.New("no tax rule for the destination")
+	ErrCantLoadRules        = errors.New("cannot load tax rules")
+)
+
+type Destination struct {
+	Country  string
+	PostCode string
+}
+
+type Result struct {
+	Lines    []models.TaxLine
+	Subtotal money.Money
+	Tax      money.Money
+	Total    money.Money
+	Included bool
+}
+
+// TaxCalculator expects every item to be priced in currency already.
+type TaxCalculator interface {
+	Calculate(dest Destination, currency string, items []models.ProductInCart) (Result, error)
+}
+
+func DestinationFromAddress(address *models.Address) Destination {
+	if address == nil {
+		return Destination{}
+	}
+
+	return Destination{Country: address.Country, PostCode: address.PostCode}
+}
@@ -0,0 +1,45 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// NewOneTimeToken returns a random token to hand to the user and the hash to
+// store, so that a leaked database does not leak usable tokens.
+func NewOneTimeToken() (token, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err = rand.Read(buf); err != nil {
+		return "", "", err
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(buf)
+	return token, HashOneTimeToken(token), nil
+}
+
+func HashOneTimeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyPrefix marks API keys, so that they can be told apart from JWTs in
+// the Authorization header.
+const APIKeyPrefix = "ek_"
+
+// NewAPIKey returns a new API key and its hash.
+func NewAPIKey() (key, hash string, err error) {
+	token, _, err := NewOneTimeToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	key = APIKeyPrefix + token
+	return key, HashOneTimeToken(key), nil
+}
+
+func IsAPIKey(credentials string) bool {
+	return strings.HasPrefix(credentials, APIKeyPrefix)
+}
@@ -1,15 +1,10 @@
 package tokens
 
 import (
-	"context"
 	"errors"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/koinav/ecommerce/database"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"os"
+	"github.com/koinav/ecommerce/keyring"
+	"github.com/koinav/ecommerce/models"
 	"time"
 )
 
@@ -18,36 +13,82 @@ type SignedDetails struct {
 	FirstName string
 	LastName  string
 	Uid       string
+	Role      string
+	// TwoFactor is set when the user passed the second login step.
+	TwoFactor bool
+	// Sid is the session the token belongs to.
+	Sid string
+	// Scope is empty for access tokens and names the only thing any other
+	// token may be used for.
+	Scope string
 	jwt.StandardClaims
 }
 
-var userData *mongo.Collection = database.UserData(database.Client, "Users")
+const (
+	ScopePreAuth = "pre_auth"
+	ScopeRefresh = "refresh"
+)
+
+// Issuer signs and verifies tokens with the keys of its key ring.
+type Issuer struct {
+	keys       *keyring.Ring
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// NewIssuer signs access tokens valid for accessTTL and refresh tokens valid
+// for refreshTTL, which is how long a login lasts without logging in again.
+func NewIssuer(keys *keyring.Ring, accessTTL, refreshTTL time.Duration) *Issuer {
+	return &Issuer{keys: keys, accessTTL: accessTTL, refreshTTL: refreshTTL}
+}
 
-var SecretKey = os.Getenv("SECRET_KEY")
+func (issuer *Issuer) RefreshTTL() time.Duration {
+	return issuer.refreshTTL
+}
+
+func (issuer *Issuer) sign(claims jwt.Claims) (string, error) {
+	key, err := issuer.keys.SigningKey(time.Now())
+	if err != nil {
+		return "", err
+	}
 
-func TokenGenerator(email, firstName, lastName, uid string) (token, refreshToken string, err error) {
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.PrivateKey())
+}
+
+func (issuer *Issuer) TokenGenerator(email, firstName, lastName, uid, role, sid string, twoFactor bool) (token, refreshToken string, err error) {
 	claims := &SignedDetails{
+		Sid:       sid,
 		Email:     email,
 		FirstName: firstName,
 		LastName:  lastName,
 		Uid:       uid,
+		Role:      role,
+		TwoFactor: twoFactor,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Local().Add(time.Hour * time.Duration(24)).Unix(),
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Local().Add(issuer.accessTTL).Unix(),
 		},
 	}
 
 	refreshClaims := &SignedDetails{
+		Uid:   uid,
+		Sid:   sid,
+		Scope: ScopeRefresh,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Local().Add(time.Hour * time.Duration(168)).Unix(),
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Local().Add(issuer.refreshTTL).Unix(),
 		},
 	}
 
-	token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(SecretKey))
+	token, err = issuer.sign(claims)
 	if err != nil {
 		return "", "", err
 	}
 
-	refreshToken, err = jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims).SignedString([]byte(SecretKey))
+	refreshToken, err = issuer.sign(refreshClaims)
 	if err != nil {
 		return "", "", err
 	}
@@ -55,9 +96,46 @@ func TokenGenerator(email, firstName, lastName, uid string) (token, refreshToken
 	return token, refreshToken, nil
 }
 
-func ValidateToken(signedToken string) (claims *SignedDetails, err error) {
+// PreAuthToken proves that the password was correct and is exchanged for
+// the real token pair once the second factor is checked.
+func (issuer *Issuer) PreAuthToken(uid string, ttl time.Duration) (string, error) {
+	claims := &SignedDetails{
+		Uid:   uid,
+		Scope: ScopePreAuth,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(ttl).Unix(),
+		},
+	}
+
+	return issuer.sign(claims)
+}
+
+func (issuer *Issuer) ValidatePreAuthToken(signedToken string) (*SignedDetails, error) {
+	claims, err := issuer.ValidateToken(signedToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Scope != ScopePreAuth {
+		return nil, errors.New("not a pre-auth token")
+	}
+
+	return claims, nil
+}
+
+func (issuer *Issuer) ValidateToken(signedToken string) (claims *SignedDetails, err error) {
 	token, err := jwt.ParseWithClaims(signedToken, &SignedDetails{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(SecretKey), nil
+		kid, _ := token.Header["kid"].(string)
+		key, err := issuer.keys.VerificationKey(kid, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		// The algorithm comes with the token, so it must match the key.
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, errors.New("unexpected signing method")
+		}
+
+		return key.PublicKey(), nil
 	})
 
 	if err != nil {
@@ -76,27 +154,11 @@ func ValidateToken(signedToken string) (claims *SignedDetails, err error) {
 	return claims, nil
 }
 
-func UpdateAllTokens(token, refreshToken string, userID string) error {
-	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-	defer cancel()
-
-	var updateObj primitive.D
-
-	updateObj = append(updateObj, bson.E{Key: "token", Value: token})
-	updateObj = append(updateObj, bson.E{Key: "refresh_token", Value: refreshToken})
-	updatedAt := time.Now()
-	updateObj = append(updateObj, bson.E{Key: "updated_at", Value: updatedAt})
-
-	upsert := true
-
-	filter := bson.M{"user_id": userID}
-	opt := options.UpdateOptions{
-		Upsert: &upsert,
-	}
-	_, err := userData.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: updateObj}}, &opt)
-
-	if err != nil {
-		return err
+// CheckRevoked rejects tokens issued to user before the user's tokens were
+// revoked, e.g. by a password reset.
+func CheckRevoked(claims *SignedDetails, user *models.User) error {
+	if !user.TokensRevokedAt.IsZero() && claims.IssuedAt < user.TokensRevokedAt.Unix() {
+		return errors.New("token revoked")
 	}
 
 	return nil
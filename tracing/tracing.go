@@ -0,0 +1,73 @@
+// Package tracing builds the OpenTelemetry tracer provider of a server. The
+// provider is passed to the instrumented libraries explicitly instead of
+// being installed globally.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"github.com/koinav/ecommerce/config"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"os"
+)
+
+var ErrUnknownExporter = errors.New("unknown trace exporter")
+
+type Tracing struct {
+	Provider trace.TracerProvider
+	// Propagator reads and writes the W3C traceparent, tracestate and
+	// baggage headers.
+	Propagator propagation.TextMapPropagator
+	shutdown   func(ctx context.Context) error
+}
+
+// New sets up the exporter chosen in cfg. With the none exporter spans are
+// not recorded at all, but trace context is still propagated.
+func New(ctx context.Context, cfg config.Tracing) (*Tracing, error) {
+	tracing := &Tracing{
+		Propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "none":
+		tracing.Provider = noop.NewTracerProvider()
+		tracing.shutdown = func(context.Context) error { return nil }
+		return tracing, nil
+	case "otlp":
+		var options []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, options...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	default:
+		return nil, ErrUnknownExporter
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName))),
+	)
+	tracing.Provider = provider
+	tracing.shutdown = provider.Shutdown
+
+	return tracing, nil
+}
+
+// Shutdown exports the spans still buffered and stops the exporter.
+func (tracing *Tracing) Shutdown(ctx context.Context) error {
+	return tracing.shutdown(ctx)
+}